@@ -1,17 +1,25 @@
 package application
 
 import (
+	"context"
+	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/carbocation/interpose"
 	"github.com/gomodule/redigo/redis"
 	gorilla_mux "github.com/gorilla/mux"
+	"github.com/jfardello/dsc-go/certstore"
 	"github.com/jfardello/dsc-go/handlers"
+	"github.com/jfardello/dsc-go/peerstore"
+	"github.com/jfardello/dsc-go/snapstore"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"github.com/throttled/throttled"
 	"github.com/throttled/throttled/store/memstore"
 	"github.com/throttled/throttled/store/redigostore"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/http/pprof"
 	"net/url"
 	"os"
 	"regexp"
@@ -21,11 +29,12 @@ import (
 )
 
 type responseHeadersTransport struct {
-	headers []string
+	transport http.RoundTripper
+	headers   []string
 }
 
 func (t responseHeadersTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	resp, err := http.DefaultTransport.RoundTrip(r)
+	resp, err := t.transport.RoundTrip(r)
 	if err != nil {
 		return nil, err
 	}
@@ -38,19 +47,152 @@ func (t responseHeadersTransport) RoundTrip(r *http.Request) (*http.Response, er
 
 // New is the constructor for Application struct.
 func New(config *viper.Viper) (*Application, error) {
-	app := &Application{}
+	app := &Application{
+		stop:      make(chan struct{}),
+		readiness: &handlers.Readiness{},
+		upgrades:  handlers.NewUpgrades(),
+	}
 	app.config = config
 	return app, nil
 }
 
 // Application is the application object that runs HTTP server.
 type Application struct {
-	config *viper.Viper
+	config    *viper.Viper
+	peers     *peerstore.Store
+	snapshot  *snapstore.Store
+	certs     *certstore.Store
+	metrics   *handlers.RequestMetrics
+	env       *handlers.Env
+	readiness *handlers.Readiness
+	upgrades  *handlers.Upgrades
+	stop      chan struct{}
+}
+
+// Drain marks the instance as not ready, for load balancers to stop sending it new requests.
+func (app *Application) Drain() {
+	app.readiness.Drain()
+}
+
+// DrainUpgrades waits for the proxied websockets to be closed until ctx is done, then closes the remaining ones
+// and returns how many were.
+func (app *Application) DrainUpgrades(ctx context.Context) int {
+	return app.upgrades.Drain(ctx)
+}
+
+// Close stops background work and saves the throttle snapshot, it's meant to be called once the server has
+// drained.
+func (app *Application) Close() error {
+	logrus.Infoln("Flushing throttle stores")
+	if app.stop != nil {
+		close(app.stop)
+	}
+	if app.snapshot == nil {
+		return nil
+	}
+	path := app.config.GetString("snapshot_file")
+	if err := app.snapshot.Save(path); err != nil {
+		return err
+	}
+	logrus.Infoln("Saved throttle snapshot to " + path)
+	return nil
+}
+
+// PeerHandler returns the handler peers use to share throttle state, or nil when peering is disabled. It's only
+// set once MiddlewareStruct has been called.
+func (app *Application) PeerHandler() http.Handler {
+	if app.peers == nil {
+		return nil
+	}
+	return app.peers
+}
+
+// AdminHandler returns the handler of the admin listener, serving the probes, metrics, pprof and the bans api, or
+// nil when DSC_ADMIN_ADDR isn't set. It's only set once MiddlewareStruct has been called. The listener token
+// defaults to DSC_ADMIN_TOKEN, and an unauthenticated listener is only allowed on a loopback address.
+func (app *Application) AdminHandler() (http.Handler, error) {
+	addr := app.config.GetString("admin_addr")
+	if app.env == nil || addr == "" {
+		return nil, nil
+	}
+	token := app.config.GetString("admin_listener_token")
+	if token == "" {
+		token = app.config.GetString("admin_token")
+	}
+	if token == "" && !loopback(addr) {
+		return nil, errors.New("DSC_ADMIN_ADDR isn't a loopback address, set DSC_ADMIN_LISTENER_TOKEN")
+	}
+	router := gorilla_mux.NewRouter()
+	router.Handle("/status", handlers.Handler{Env: app.env, H: handlers.Status})
+	router.Handle("/live", handlers.Handler{Env: app.env, H: handlers.Live})
+	router.Handle("/ready", handlers.Handler{Env: app.env, H: handlers.Ready})
+	router.Handle("/health", handlers.Handler{Env: app.env, H: handlers.AdminHealth})
+	router.Handle("/metrics", handlers.Handler{Env: app.env, H: handlers.Metrics})
+	router.Handle("/bans", handlers.Handler{Env: app.env, H: handlers.AdminBans}).Methods("GET", "DELETE")
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	return handlers.RequireToken(token, []string{"/status", "/live", "/ready"})(router), nil
+}
+
+// loopback tells whether the listen address addr only accepts local connections.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func (app *Application) MiddlewareStruct() (*interpose.Middleware, error) {
 	middle := interpose.New()
-	middle.UseHandler(app.mux())
+	// Forged forwarding headers are dropped before anything reads them.
+	proxies, err := handlers.ParseNetworks(strings.Split(app.config.GetString("trusted_proxies"), ","))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad DSC_TRUSTED_PROXIES")
+	}
+	middle.Use(handlers.TrustedProxies(proxies, app.config.GetString("forwarded_headers") == "strip"))
+	if app.config.GetString("admin_addr") != "" {
+		app.metrics = handlers.NewRequestMetrics()
+		middle.Use(app.metrics.Count)
+	}
+	trusted, err := handlers.ParseNetworks(strings.Split(app.config.GetString("request_id_trusted"), ","))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad DSC_REQUEST_ID_TRUSTED")
+	}
+	middle.Use(handlers.RequestIDs(app.config.GetString("request_id_header"), trusted))
+	identityRules, err := handlers.ParseIdentityRules(app.config.GetString("tls_client_rules"))
+	if err != nil {
+		return nil, err
+	}
+	middle.Use(handlers.ClientCertificates(identityRules, app.config.GetString("tls_client_identity_header"),
+		logrus.StandardLogger()))
+	hsts, err := hstsValue(app.config)
+	if err != nil {
+		return nil, err
+	}
+	if hsts != "" {
+		middle.Use(handlers.HSTS(hsts))
+	}
+	rules, err := handlers.ParseHeaderRules(app.config.GetString("response_headers"))
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		middle.Use(handlers.ResponseHeaders(rules))
+	}
+	limits, err := newLimitRoutes(app.config)
+	if err != nil {
+		return nil, err
+	}
+	middle.Use(handlers.Limits(limits))
+	middle.UseHandler(app.mux(identityRules))
 	return middle, nil
 }
 
@@ -71,13 +213,30 @@ func singleJoiningSlash(a, b string) string {
 	return a + b
 }
 
-func NewProxy(u *url.URL) *httputil.ReverseProxy {
+// ProxyOptions tune the requests NewProxy forwards.
+type ProxyOptions struct {
+	// PreserveHost keeps the client's Host header instead of rewriting it to the upstream host.
+	PreserveHost bool
+	// FlushInterval is httputil.ReverseProxy's, negative values flush after every write.
+	FlushInterval time.Duration
+	// Forwarded is "keep" or "strip" to add the forwarding headers a load balancer in front of DSC didn't set,
+	// or "off" to leave them alone. Forged ones are stripped by handlers.TrustedProxies.
+	Forwarded string
+}
+
+func NewProxy(u *url.URL, transport http.RoundTripper, options ProxyOptions) *httputil.ReverseProxy {
 	targetQuery := u.RawQuery
-	RemoveHeaders := responseHeadersTransport{headers: []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials"}}
+	RemoveHeaders := responseHeadersTransport{transport: transport,
+		headers: []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials"}}
 
 	return &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			req.Host = u.Host
+			if options.Forwarded != "off" {
+				handlers.SetForwarded(req)
+			}
+			if !options.PreserveHost {
+				req.Host = u.Host
+			}
 			req.URL.Scheme = u.Scheme
 			req.URL.Host = u.Host
 			req.URL.Path = singleJoiningSlash(u.Path, req.URL.Path)
@@ -88,28 +247,276 @@ func NewProxy(u *url.URL) *httputil.ReverseProxy {
 				req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
 			}
 		},
-		Transport: RemoveHeaders,
+		Transport:     RemoveHeaders,
+		FlushInterval: options.FlushInterval,
 	}
 }
 
+// redisDialTimeout bounds connecting to redis, which would otherwise wait for the OS to give up.
+const redisDialTimeout = 5 * time.Second
+
 func newPool(addr string) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, redis.DialConnectTimeout(redisDialTimeout))
+		},
+	}
+}
+
+// parseQuota parses a "max,burst" throttle setting for a "D", "H" or "M" period.
+func parseQuota(throttle, period string) (throttled.RateQuota, error) {
+	var re = regexp.MustCompile(`(?P<max>[0-9]+),(?P<burst>[0-9]+)`)
+
+	if !re.MatchString(throttle) {
+		return throttled.RateQuota{}, errors.Errorf("bad throttle %q, want max,burst", throttle)
+	}
+	s := re.FindStringSubmatch(throttle)
+
+	max, _ := strconv.Atoi(s[1])
+	burst, _ := strconv.Atoi(s[2])
+	if max < 1 {
+		return throttled.RateQuota{}, errors.New("max requests per period can't be zero")
+	}
+
+	switch period {
+	case "D":
+		return throttled.RateQuota{MaxRate: throttled.PerDay(max), MaxBurst: burst}, nil
+	case "H":
+		return throttled.RateQuota{MaxRate: throttled.PerHour(max), MaxBurst: burst}, nil
 	}
+	return throttled.RateQuota{MaxRate: throttled.PerMin(max), MaxBurst: burst}, nil
 }
 
-func (app *Application) mux() *gorilla_mux.Router {
+func newResponseThrottle(config *viper.Viper, store throttled.GCRAStore, prefixes []string,
+	denied *handlers.DeniedResponse) (*handlers.ResponseThrottle, error) {
+	quota, err := parseQuota(config.GetString("response_throttle"), config.GetString("response_throttle_period"))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad DSC_RESPONSE_THROTTLE")
+	}
+	limiter, err := throttled.NewGCRARateLimiter(store, quota)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []int
+	for _, field := range strings.Split(config.GetString("response_throttle_statuses"), ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, errors.Wrap(err, "bad DSC_RESPONSE_THROTTLE_STATUSES")
+		}
+		statuses = append(statuses, status)
+	}
+	return handlers.NewResponseThrottle(limiter, prefixes, statuses, config.GetString("response_throttle_key"), denied)
+}
+
+func newTarpit(config *viper.Viper) (*handlers.Tarpit, error) {
+	delay, err := time.ParseDuration(config.GetString("tarpit_delay"))
+	if err != nil {
+		return nil, err
+	}
+	maxDelay, err := time.ParseDuration(config.GetString("tarpit_max_delay"))
+	if err != nil {
+		return nil, err
+	}
+	if delay <= 0 || config.GetInt("tarpit_max_held") < 1 {
+		return nil, errors.New("DSC_TARPIT_DELAY and DSC_TARPIT_MAX_HELD must be greater than zero")
+	}
+	return handlers.NewTarpit(delay, maxDelay, config.GetInt("tarpit_max_held"), config.GetString("tarpit_then") == "serve"), nil
+}
+
+// newSnapshot restores the snapshot at path into store and saves it back periodically.
+func newSnapshot(config *viper.Viper, store throttled.GCRAStore, path string, stop chan struct{},
+	log *logrus.Logger) (*snapstore.Store, error) {
+	interval, err := time.ParseDuration(config.GetString("snapshot_interval"))
+	if err != nil {
+		return nil, err
+	}
+	snapshot := snapstore.New(store)
+	restored, err := snapshot.Load(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading throttle snapshot %s", path)
+	}
+	log.WithFields(logrus.Fields{"path": path, "keys": restored}).Info("Restored throttle snapshot.")
+	if interval > 0 {
+		go snapshot.Run(path, interval, stop, log)
+	}
+	return snapshot, nil
+}
+
+// newPeerStore shares the throttle state held in local with the peers listed in DSC_PEERS or resolved from
+// DSC_PEERS_DNS, until stop is closed.
+func newPeerStore(config *viper.Viper, local throttled.GCRAStore, stop chan struct{},
+	log *logrus.Logger) (*peerstore.Store, error) {
+	self := config.GetString("peer_advertise")
+	if _, _, err := net.SplitHostPort(self); err != nil {
+		return nil, errors.Wrap(err, "DSC_PEER_ADVERTISE must be the host:port other peers reach this instance at")
+	}
+	peers := peerstore.New(self, local, []byte(config.GetString("secret")), log)
+	if static := config.GetString("peers"); static != "" {
+		peers.SetPeers(strings.Split(static, ","))
+	}
+	if name := config.GetString("peers_dns"); name != "" {
+		_, port, err := net.SplitHostPort(config.GetString("peer_addr"))
+		if err != nil {
+			return nil, errors.Wrap(err, "bad DSC_PEER_ADDR")
+		}
+		interval, err := time.ParseDuration(config.GetString("peers_dns_interval"))
+		if err != nil {
+			return nil, err
+		}
+		go peers.Discover(name, port, interval, stop)
+	}
+	return peers, nil
+}
+
+func newPenaltyBox(config *viper.Viper, store throttled.GCRAStore, maxFailures int) (*handlers.PenaltyBox, error) {
+	var durations []time.Duration
+	for _, key := range []string{"ban_window", "ban_time", "ban_max_time"} {
+		d, err := time.ParseDuration(config.GetString(key))
+		if err != nil {
+			return nil, err
+		}
+		durations = append(durations, d)
+	}
+	return handlers.NewPenaltyBox(store, maxFailures, durations[0], durations[1], durations[2])
+}
+
+// newConcurrencyRoutes builds a limiter for every route in concurrency_routes, whose values are
+// "limit[:max_limit[:queue]]", plus a default one for the remaining paths.
+func newConcurrencyRoutes(config *viper.Viper, algorithm string) (*handlers.Routes, error) {
+	timeout, err := time.ParseDuration(config.GetString("concurrency_queue_timeout"))
+	if err != nil {
+		return nil, err
+	}
+	spec, err := handlers.ParseRouteSpec(config.GetString("concurrency_routes"))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := spec["/"]; !ok {
+		spec["/"] = ""
+	}
+
+	routes := &handlers.Routes{}
+	for prefix, value := range spec {
+		limits := []int{config.GetInt("concurrency_limit"), config.GetInt("concurrency_max_limit"),
+			config.GetInt("concurrency_queue")}
+		for i, field := range strings.Split(value, ":") {
+			if field == "" || i >= len(limits) {
+				continue
+			}
+			if limits[i], err = strconv.Atoi(field); err != nil {
+				return nil, errors.Wrapf(err, "bad concurrency setting for %s", prefix)
+			}
+		}
+		if limits[0] < 1 {
+			return nil, errors.Errorf("concurrency limit for %s must be greater than zero", prefix)
+		}
+		a, err := handlers.NewLimitAlgorithm(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		routes.Add(prefix, handlers.NewConcurrencyLimiter(a, limits[0], limits[1], limits[2], timeout))
+	}
+	return routes, nil
+}
+
+// newLimitRoutes reads the request limits, limits_routes overrides them per route with
+// "/prefix=max_body_bytes:max_header_bytes:timeout" entries, empty fields keeping the global setting.
+func newLimitRoutes(config *viper.Viper) (*handlers.Routes, error) {
+	spec, err := handlers.ParseRouteSpec(config.GetString("limits_routes"))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := spec["/"]; !ok {
+		spec["/"] = ""
+	}
+
+	routes := &handlers.Routes{}
+	for prefix, value := range spec {
+		limits := &handlers.RequestLimits{
+			MaxBodyBytes:   config.GetInt64("max_body_bytes"),
+			MaxHeaderBytes: config.GetInt("http_max_header_bytes"),
+		}
+		fields := strings.Split(value, ":")
+		if len(fields) > 3 {
+			return nil, errors.Errorf("bad limits setting for %s, want max_body_bytes:max_header_bytes:timeout", prefix)
+		}
+		for i, field := range fields {
+			if field == "" {
+				continue
+			}
+			switch i {
+			case 0:
+				limits.MaxBodyBytes, err = strconv.ParseInt(field, 10, 64)
+			case 1:
+				limits.MaxHeaderBytes, err = strconv.Atoi(field)
+			case 2:
+				limits.Timeout, err = time.ParseDuration(field)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad limits setting for %s", prefix)
+			}
+		}
+		routes.Add(prefix, limits)
+	}
+	return routes, nil
+}
+
+// newUpstream wraps transport with the upstream timeouts, retries and circuit breaker. Timeout prefixes are
+// given as seen by clients and rebased on the upstream path.
+func newUpstream(config *viper.Viper, u *url.URL, transport http.RoundTripper,
+	log *logrus.Logger) (*handlers.UpstreamTransport, error) {
+	upstream := &handlers.UpstreamTransport{
+		Transport: transport,
+		Timeouts:  &handlers.Routes{},
+		Retries:   config.GetInt("upstream_retries"),
+		Log:       log,
+	}
+	spec, err := handlers.ParseRouteSpec(config.GetString("upstream_timeout_routes"))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := spec["/"]; !ok {
+		spec["/"] = config.GetString("upstream_timeout")
+	}
+	for prefix, value := range spec {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad upstream timeout for %s", prefix)
+		}
+		upstream.Timeouts.Add(singleJoiningSlash(u.Path, prefix), timeout)
+	}
+	if upstream.Retries > 0 {
+		if upstream.Backoff, err = time.ParseDuration(config.GetString("upstream_retry_backoff")); err != nil {
+			return nil, errors.Wrap(err, "bad DSC_UPSTREAM_RETRY_BACKOFF")
+		}
+		if upstream.Backoff < 0 {
+			return nil, errors.New("DSC_UPSTREAM_RETRY_BACKOFF must not be negative")
+		}
+		upstream.Budget = handlers.NewRetryBudget(config.GetFloat64("upstream_retry_budget"))
+	}
+	if failures := config.GetInt("upstream_breaker_failures"); failures > 0 {
+		cooldown, err := time.ParseDuration(config.GetString("upstream_breaker_cooldown"))
+		if err != nil {
+			return nil, errors.Wrap(err, "bad DSC_UPSTREAM_BREAKER_COOLDOWN")
+		}
+		upstream.Breaker = handlers.NewBreaker(failures, cooldown)
+	}
+	return upstream, nil
+}
+
+func (app *Application) mux(identityRules []handlers.IdentityRule) *gorilla_mux.Router {
 
 	router := gorilla_mux.NewRouter()
 	u, err := url.Parse(app.config.GetString("upstream"))
 
 	env := handlers.Env{
-		MaxTime:      app.config.GetInt64("max_time"),
-		DSCKey:       app.config.GetString("secret"),
-		CustomHeader: app.config.GetString("custom_header"),
-		Proto:        app.config.GetString("proto"),
+		MaxTime:       app.config.GetInt64("max_time"),
+		DSCKey:        app.config.GetString("secret"),
+		CustomHeader:  app.config.GetString("custom_header"),
+		Proto:         app.config.GetString("proto"),
+		KeepDSCParams: app.config.GetBool("keep_dsc_params"),
 		Log: &logrus.Logger{
 			Out:   os.Stderr,
 			Level: logrus.InfoLevel,
@@ -118,53 +525,111 @@ func (app *Application) mux() *gorilla_mux.Router {
 			},
 		},
 	}
+	var transport http.RoundTripper
 	if err == nil {
-		env.Proxy = NewProxy(u)
+		var socket string
+		u, socket = upstreamSocket(u)
+		if app.config.GetBool("upstream_h2c") && u.Scheme != "http" {
+			logrus.Fatal("DSC_UPSTREAM_H2C needs an http:// or unix:// DSC_UPSTREAM")
+		}
+		transport, err = newUpstreamTransport(app.config, u, socket)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		upstream, err := newUpstream(app.config, u, transport, env.Log)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		env.Breaker = upstream.Breaker
+		options := ProxyOptions{Forwarded: app.config.GetString("forwarded_headers")}
+		if options.FlushInterval, err = time.ParseDuration(app.config.GetString("upstream_flush_interval")); err != nil {
+			logrus.Fatal(errors.Wrap(err, "bad DSC_UPSTREAM_FLUSH_INTERVAL"))
+		}
+		switch app.config.GetString("upstream_host_mode") {
+		case "preserve":
+			options.PreserveHost = true
+		case "rewrite":
+		default:
+			logrus.Fatal("DSC_UPSTREAM_HOST_MODE must be rewrite or preserve")
+		}
+		switch options.Forwarded {
+		case "keep", "strip", "off":
+		default:
+			logrus.Fatal("DSC_FORWARDED_HEADERS must be keep, strip or off")
+		}
+		env.Proxy = NewProxy(u, upstream, options)
+		env.Proxy.ErrorHandler = handlers.ProxyError(handlers.Fallback{
+			Status:      app.config.GetInt("upstream_fallback_status"),
+			ContentType: app.config.GetString("upstream_fallback_content_type"),
+			Body:        app.config.GetString("upstream_fallback_body"),
+		}, upstream.Breaker, env.Log)
 	}
 
 	redisUrl := app.config.GetString("throttle_redis_url")
 
 	var store throttled.GCRAStore
+	var pool *redis.Pool
 	if redisUrl == "" {
 
 		store, err = memstore.New(65536)
 		if err != nil {
 			logrus.Fatal(err)
 		}
+		if path := app.config.GetString("snapshot_file"); path != "" {
+			app.snapshot, err = newSnapshot(app.config, store, path, app.stop, env.Log)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			store = app.snapshot
+		}
+		if app.config.GetString("peers") != "" || app.config.GetString("peers_dns") != "" {
+			app.peers, err = newPeerStore(app.config, store, app.stop, env.Log)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			store = app.peers
+		}
 	} else {
-		pool := newPool(redisUrl)
+		pool = newPool(redisUrl)
 		store, err = redigostore.New(pool, "", 0)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	var quota throttled.RateQuota
-	var re = regexp.MustCompile(`(?P<max>[0-9]+),(?P<burst>[0-9]+)`)
-
-	if !re.MatchString(app.config.GetString("throttle")) {
-		panic("Bad  DSC_THROTTLE config.")
-
+	if maxFailures := app.config.GetInt("ban_max_failures"); maxFailures > 0 {
+		env.Bans, err = newPenaltyBox(app.config, store, maxFailures)
+		if err != nil {
+			logrus.Fatal(err)
+		}
 	}
-	s := re.FindStringSubmatch(app.config.GetString("throttle"))
+	env.AdminToken = app.config.GetString("admin_token")
 
-	max, _ := strconv.Atoi(s[1])
-	burst, _ := strconv.Atoi(s[2])
-	if max < 1 {
-		panic("Invalid config for DSC_THROTTLE: max requests per period can't be zero.")
+	env.UpstreamHeaders, err = handlers.ParseHeaderRules(app.config.GetString("upstream_headers"))
+	if err != nil {
+		logrus.Fatal(err)
 	}
+	env.IdentityRules = identityRules
 
-	switch app.config.GetString("throttle_period") {
+	for key, d := range map[string]*time.Duration{
+		"websocket_idle_timeout": &env.WebSocketIdleTimeout,
+		"websocket_max_lifetime": &env.WebSocketMaxLifetime,
+	} {
+		if *d, err = time.ParseDuration(app.config.GetString(key)); err != nil {
+			logrus.Fatalf("Invalid config for DSC_%s: %s", strings.ToUpper(key), err)
+		}
+	}
 
-	case "D":
-		quota = throttled.RateQuota{MaxRate: throttled.PerDay(max), MaxBurst: burst}
-	case "H":
-		quota = throttled.RateQuota{MaxRate: throttled.PerHour(max), MaxBurst: burst}
-	case "M":
-		quota = throttled.RateQuota{MaxRate: throttled.PerMin(max), MaxBurst: burst}
-	default:
-		quota = throttled.RateQuota{MaxRate: throttled.PerMin(max), MaxBurst: burst}
+	if algorithm := app.config.GetString("concurrency_algorithm"); algorithm != "" {
+		env.Concurrency, err = newConcurrencyRoutes(app.config, algorithm)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
 
+	quota, err := parseQuota(app.config.GetString("throttle"), app.config.GetString("throttle_period"))
+	if err != nil {
+		panic(fmt.Sprintf("Invalid config for DSC_THROTTLE: %s", err))
 	}
 	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
 	if err != nil {
@@ -175,26 +640,92 @@ func (app *Application) mux() *gorilla_mux.Router {
 		logrus.Fatal(err)
 	}
 
+	denied, err := handlers.NewDeniedResponse(app.config.GetString("throttle_denied_format"),
+		app.config.GetString("throttle_denied_template"), app.config.GetString("throttle_denied_content_type"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if prefixes := app.config.GetString("response_throttle_routes"); prefixes != "" {
+		env.Responses, err = newResponseThrottle(app.config, store, strings.Split(prefixes, ","), denied)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	costs, err := handlers.ParseCosts(app.config.GetString("throttle_costs"), app.config.GetInt("throttle_body_cost"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	highest := costs.Max()
+	maxBody := app.config.GetInt64("max_body_bytes")
+	if maxBody > 0 {
+		highest += costs.Body(maxBody)
+	}
+	if highest > quota.MaxBurst+1 {
+		logrus.Warnf("DSC_THROTTLE burst is lower than the highest throttle cost (%d), those requests will be denied.",
+			highest)
+	} else if costs.BodyCost > 0 && maxBody == 0 {
+		logrus.Warnf("DSC_THROTTLE_BODY_COST is set without DSC_MAX_BODY_BYTES, bodies over %d MiB will be denied.",
+			(quota.MaxBurst+1-costs.Max())/costs.BodyCost)
+	}
+
 	//Rate limiter for dscservice & judge endpoints
-	rl := throttled.HTTPRateLimiter{RateLimiter: rateLimiter}
+	rl := handlers.Throttle{RateLimiter: rateLimiter, Denied: denied, Log: env.Log}
 
 	//Rate limiter for the proxy
-	pl := throttled.HTTPRateLimiter{RateLimiter: proxyLimiter}
+	pl := handlers.Throttle{RateLimiter: proxyLimiter, Costs: costs, Denied: denied, Log: env.Log}
+
+	tarpit, err := newTarpit(app.config)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	for _, class := range []struct {
+		throttle *handlers.Throttle
+		key      string
+	}{{&rl, "throttle_action_service"}, {&pl, "throttle_action_proxy"}} {
+		switch app.config.GetString(class.key) {
+		case "tarpit":
+			class.throttle.Tarpit = tarpit
+		case "reject":
+		default:
+			logrus.Fatalf("Invalid config for DSC_%s, want reject or tarpit.", strings.ToUpper(class.key))
+		}
+	}
 
 	if env.Proto == "both" {
-		rl.VaryBy = &throttled.VaryBy{Path: true, RemoteAddr: true, Headers: []string{"X-Forwarded-For", "X-Real-IP"}}
+		rl.VaryBy = handlers.VaryByClient(true)
 		pl.VaryBy = &throttled.VaryBy{Path: false, RemoteAddr: false, Custom: getHmacParam}
 	} else {
-		vb := &throttled.VaryBy{Path: true, RemoteAddr: true, Headers: []string{"X-Forwarded-For", "X-Real-IP"}}
+		vb := handlers.VaryByClient(true)
 		rl.VaryBy = vb
 		pl.VaryBy = vb
 	}
 
+	if env.Health, err = app.newHealthChecks(pool, u, transport); err != nil {
+		logrus.Fatal(err)
+	}
+
+	env.Metrics = app.metrics
+	env.Readiness = app.readiness
+	env.Upgrades = app.upgrades
+	app.env = &env
+
 	router.Handle("/_dsc/judge/{orig:.+}", rl.RateLimit(handlers.Handler{Env: &env, H: handlers.JudgeW}))
 	router.Handle("/_dsc/dscservice", rl.RateLimit(handlers.Handler{Env: &env, H: handlers.Dsservice}))
 	router.Handle("/_dsc/status", handlers.Handler{Env: &env, H: handlers.Status})
+	router.Handle("/_dsc/live", handlers.Handler{Env: &env, H: handlers.Live})
+	router.Handle("/_dsc/ready", handlers.Handler{Env: &env, H: handlers.Ready})
+	// Operations move to the admin listener when there's one.
+	if env.AdminToken != "" && app.config.GetString("admin_addr") == "" {
+		router.Handle("/_dsc/bans", handlers.Handler{Env: &env, H: handlers.Bans}).Methods("GET", "DELETE")
+		router.Handle("/_dsc/health", handlers.Handler{Env: &env, H: handlers.Health})
+	}
 	if env.Proxy != nil {
-		router.PathPrefix("/").Handler(pl.RateLimit(handlers.Handler{Env: &env, H: handlers.ProxyHandler}))
+		proxy := pl.RateLimit(handlers.Handler{Env: &env, H: handlers.ProxyHandler})
+		// Websocket handshakes are charged to both throttles, as they open a long lived connection.
+		router.PathPrefix("/").HeadersRegexp("Upgrade", "(?i)^websocket$").Handler(rl.RateLimit(proxy))
+		router.PathPrefix("/").Handler(proxy)
 	}
 
 	return router
@@ -0,0 +1,143 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/gomodule/redigo/redis"
+	"github.com/google/uuid"
+	"github.com/jfardello/dsc-go/handlers"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newHealthChecks builds the readiness checks from the health_* settings: the keys are always checked, redis when
+// pool isn't nil, the upstream when transport isn't nil and the served certificates once TLS is set up.
+func (app *Application) newHealthChecks(pool *redis.Pool, u *url.URL,
+	transport http.RoundTripper) (*handlers.HealthChecks, error) {
+	timeout, err := time.ParseDuration(app.config.GetString("health_timeout"))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad DSC_HEALTH_TIMEOUT")
+	}
+	ttl, err := time.ParseDuration(app.config.GetString("health_cache_ttl"))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad DSC_HEALTH_CACHE_TTL")
+	}
+
+	secret := []byte(app.config.GetString("secret"))
+	checks := []handlers.HealthCheck{{Name: "keys", Check: func(context.Context) error {
+		return app.checkKeys(secret)
+	}}}
+	if pool != nil {
+		checks = append(checks, handlers.HealthCheck{Name: "redis", Check: func(ctx context.Context) error {
+			conn, err := pool.GetContext(ctx)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			_, err = redis.DoWithTimeout(conn, timeout, "PING")
+			return err
+		}})
+	}
+	if transport != nil {
+		target := *u
+		target.Path = singleJoiningSlash(u.Path, app.config.GetString("health_upstream_path"))
+		checks = append(checks, handlers.HealthCheck{Name: "upstream", Check: func(ctx context.Context) error {
+			return checkUpstream(ctx, transport, target.String())
+		}})
+	}
+	if app.config.GetString("http_cert_file") != "" {
+		checks = append(checks, handlers.HealthCheck{Name: "certificates", Check: func(context.Context) error {
+			return app.checkCertificates(time.Now())
+		}})
+	}
+	return handlers.NewHealthChecks(timeout, ttl, checks...), nil
+}
+
+// checkUpstream tells whether the upstream answers target, any response but a server error will do.
+func checkUpstream(ctx context.Context, transport http.RoundTripper, target string) error {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return errors.Errorf("upstream answered %s", res.Status)
+	}
+	return nil
+}
+
+// checkKeys tells whether secret signs and verifies dscv values, and whether the private key of every served
+// certificate is loaded, matches its certificate and signs.
+func (app *Application) checkKeys(secret []byte) error {
+	if len(secret) < 16 {
+		return errors.New("DSC_SECRET is missing or shorter than 16 characters")
+	}
+	u := uuid.New()
+	mac, err := base64.StdEncoding.DecodeString(handlers.CreateMAC(&u, secret))
+	if err != nil || !handlers.CheckMAC([]byte(u.String()), mac, secret) {
+		return errors.New("DSC_SECRET doesn't verify the values it signs")
+	}
+	if app.certs == nil {
+		return nil
+	}
+	digest := sha256.Sum256([]byte(u.String()))
+	for _, cert := range app.certs.Certificates() {
+		if cert.Leaf == nil {
+			continue
+		}
+		signer, ok := cert.PrivateKey.(crypto.Signer)
+		if !ok {
+			return errors.Errorf("private key for %s isn't loaded", cert.Leaf.Subject.CommonName)
+		}
+		public, err := x509.MarshalPKIXPublicKey(signer.Public())
+		if err != nil {
+			return err
+		}
+		leaf, err := x509.MarshalPKIXPublicKey(cert.Leaf.PublicKey)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(public, leaf) {
+			return errors.Errorf("private key for %s doesn't match its certificate", cert.Leaf.Subject.CommonName)
+		}
+		if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+			return errors.Wrapf(err, "private key for %s can't sign", cert.Leaf.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+// checkCertificates tells whether every served certificate is valid at now.
+func (app *Application) checkCertificates(now time.Time) error {
+	if app.certs == nil {
+		return errors.New("certificates aren't loaded")
+	}
+	for _, cert := range app.certs.Certificates() {
+		if cert.Leaf == nil {
+			continue
+		}
+		if now.After(cert.Leaf.NotAfter) {
+			return errors.Errorf("certificate for %s expired on %s", cert.Leaf.Subject.CommonName,
+				cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(cert.Leaf.NotBefore) {
+			return errors.Errorf("certificate for %s isn't valid before %s", cert.Leaf.Subject.CommonName,
+				cert.Leaf.NotBefore.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package application
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/Sirupsen/logrus"
+	"github.com/jfardello/dsc-go/certstore"
+	"github.com/jfardello/dsc-go/handlers"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuites are the TLS 1.2 and below suites that can be enabled, RC4 and 3DES ones are left out. TLS 1.3
+// suites aren't configurable.
+var cipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":               tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":          tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":        tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// splitList splits a coma separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// TLSConfig returns the listener's TLS configuration, or nil when no certificate is configured. Certificates
+// are picked by SNI and reloaded when their files change.
+func (app *Application) TLSConfig() (*tls.Config, error) {
+	certFiles, keyFiles := app.config.GetString("http_cert_file"), app.config.GetString("http_key_file")
+	if certFiles == "" && keyFiles == "" {
+		return nil, nil
+	}
+	pairs, err := certstore.ParsePairs(certFiles, keyFiles, app.config.GetString("tls_ocsp_staple_file"))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad DSC_HTTP_CERT_FILE, DSC_HTTP_KEY_FILE or DSC_TLS_OCSP_STAPLE_FILE")
+	}
+	certs, err := certstore.New(pairs)
+	if err != nil {
+		return nil, err
+	}
+	app.certs = certs
+
+	for _, domain := range strings.Split(app.config.GetString("domains"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" && !certs.Covers(domain) {
+			logrus.Warnf("No certificate covers %s, the default one will be served.", domain)
+		}
+	}
+
+	interval, err := time.ParseDuration(app.config.GetString("http_cert_reload_interval"))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad DSC_HTTP_CERT_RELOAD_INTERVAL")
+	}
+	if interval > 0 {
+		go certs.Watch(interval, app.stop, logrus.StandardLogger())
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate:           certs.GetCertificate,
+		PreferServerCipherSuites: true,
+		NextProtos:               splitList(app.config.GetString("tls_alpn")),
+	}
+	if err := app.hardenTLS(tlsConfig); err != nil {
+		return nil, err
+	}
+	if err := app.clientAuth(tlsConfig); err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// clientAuth sets up client certificate verification from the tls_client_* settings.
+func (app *Application) clientAuth(tlsConfig *tls.Config) error {
+	mode := app.config.GetString("tls_client_auth")
+	switch mode {
+	case "none":
+		return nil
+	case "request":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return errors.Errorf("bad DSC_TLS_CLIENT_AUTH %q, want none, request or require", mode)
+	}
+	caFile := app.config.GetString("tls_client_ca_file")
+	if caFile == "" {
+		return errors.New("DSC_TLS_CLIENT_AUTH needs DSC_TLS_CLIENT_CA_FILE")
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return errors.Wrap(err, "reading DSC_TLS_CLIENT_CA_FILE")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.Errorf("no certificates found in %s", caFile)
+	}
+	tlsConfig.ClientCAs = pool
+	return nil
+}
+
+// hardenTLS applies the tls_* protocol version, cipher suite and curve settings.
+func (app *Application) hardenTLS(tlsConfig *tls.Config) error {
+	var ok bool
+	if tlsConfig.MinVersion, ok = tlsVersions[app.config.GetString("tls_min_version")]; !ok {
+		return errors.Errorf("bad DSC_TLS_MIN_VERSION %q, want 1.0, 1.1, 1.2 or 1.3",
+			app.config.GetString("tls_min_version"))
+	}
+	if max := app.config.GetString("tls_max_version"); max != "" {
+		if tlsConfig.MaxVersion, ok = tlsVersions[max]; !ok {
+			return errors.Errorf("bad DSC_TLS_MAX_VERSION %q, want 1.0, 1.1, 1.2 or 1.3", max)
+		}
+		if tlsConfig.MaxVersion < tlsConfig.MinVersion {
+			return errors.New("DSC_TLS_MAX_VERSION is lower than DSC_TLS_MIN_VERSION")
+		}
+	}
+
+	for _, name := range splitList(app.config.GetString("tls_cipher_suites")) {
+		id, ok := cipherSuites[name]
+		if !ok {
+			return errors.Errorf("unknown or disallowed cipher suite %s", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	if tlsConfig.CipherSuites != nil && tlsConfig.MinVersion < tls.VersionTLS13 && hasProto(tlsConfig, "h2") {
+		// HTTP/2 refuses to start without it, see RFC 7540 section 9.2.2.
+		if !hasSuite(tlsConfig, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) &&
+			!hasSuite(tlsConfig, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+			return errors.New("DSC_TLS_CIPHER_SUITES needs an ECDHE AES_128_GCM_SHA256 suite for h2")
+		}
+	}
+
+	for _, name := range splitList(app.config.GetString("tls_curves")) {
+		id, ok := curves[name]
+		if !ok {
+			return errors.Errorf("unknown curve %s, want X25519, P256, P384 or P521", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, id)
+	}
+	return nil
+}
+
+func hasProto(tlsConfig *tls.Config, proto string) bool {
+	for _, p := range tlsConfig.NextProtos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSuite(tlsConfig *tls.Config, suite uint16) bool {
+	for _, s := range tlsConfig.CipherSuites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP2 tells whether the listener offers HTTP/2, which it does unless ALPN leaves h2 out.
+func HTTP2(tlsConfig *tls.Config) bool {
+	return hasProto(tlsConfig, "h2")
+}
+
+// RedirectHandler returns the handler of the plain http listener, redirecting to https every request but the
+// health probes, which next serves.
+func (app *Application) RedirectHandler(next http.Handler) (http.Handler, error) {
+	port := app.config.GetString("http_redirect_port")
+	if port == "" {
+		_, p, err := net.SplitHostPort(app.config.GetString("http_addr"))
+		if err != nil {
+			return nil, errors.Wrap(err, "bad DSC_HTTP_ADDR")
+		}
+		port = p
+	}
+	return handlers.RedirectHTTPS(port, splitList(app.config.GetString("domains")),
+		splitList(app.config.GetString("http_redirect_exempt")), next), nil
+}
+
+// hstsValue builds the Strict-Transport-Security header from the hsts_* settings, or returns "" when disabled.
+func hstsValue(config *viper.Viper) (string, error) {
+	maxAge, err := time.ParseDuration(config.GetString("hsts_max_age"))
+	if err != nil {
+		return "", errors.Wrap(err, "bad DSC_HSTS_MAX_AGE")
+	}
+	if maxAge <= 0 {
+		return "", nil
+	}
+	value := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if config.GetBool("hsts_include_subdomains") {
+		value += "; includeSubDomains"
+	}
+	if config.GetBool("hsts_preload") {
+		value += "; preload"
+	}
+	return value, nil
+}
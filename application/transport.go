@@ -0,0 +1,133 @@
+package application
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// upstreamSocket turns a unix:///path/to/socket upstream into the http url requests are sent to, returning the
+// socket path. Other upstreams are returned as is with an empty path.
+func upstreamSocket(u *url.URL) (*url.URL, string) {
+	if u.Scheme != "unix" {
+		return u, ""
+	}
+	return &url.URL{Scheme: "http", Host: "localhost", RawQuery: u.RawQuery}, u.Path
+}
+
+// newUpstreamTransport builds the transport used to reach the upstream u from the upstream_* settings: TLS trust
+// and client certificate, SNI, timeouts and connection pool sizes. Connections go to socket instead of the
+// upstream address when it's set, and speak cleartext HTTP/2 when upstream_h2c is. HTTPS upstreams get HTTP/2
+// when they offer it, but for upgrade requests.
+func newUpstreamTransport(config *viper.Viper, u *url.URL, socket string) (http.RoundTripper, error) {
+	durations := map[string]time.Duration{}
+	for _, key := range []string{"upstream_dial_timeout", "upstream_keepalive", "upstream_tls_handshake_timeout",
+		"upstream_response_header_timeout", "upstream_idle_conn_timeout"} {
+		d, err := time.ParseDuration(config.GetString(key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad DSC_%s", key)
+		}
+		durations[key] = d
+	}
+
+	tlsConfig, err := newUpstreamTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   durations["upstream_dial_timeout"],
+		KeepAlive: durations["upstream_keepalive"],
+	}
+	dial := dialer.DialContext
+	if socket != "" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+
+	if config.GetBool("upstream_h2c") {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		}, nil
+	}
+
+	transport := func(tlsConfig *tls.Config) *http.Transport {
+		return &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dial,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   durations["upstream_tls_handshake_timeout"],
+			ResponseHeaderTimeout: durations["upstream_response_header_timeout"],
+			IdleConnTimeout:       durations["upstream_idle_conn_timeout"],
+			MaxIdleConns:          config.GetInt("upstream_max_idle_conns"),
+			MaxIdleConnsPerHost:   config.GetInt("upstream_max_idle_conns_per_host"),
+			MaxConnsPerHost:       config.GetInt("upstream_max_conns_per_host"),
+			ExpectContinueTimeout: time.Second,
+		}
+	}
+	t := transport(tlsConfig)
+	if u.Scheme != "https" {
+		return t, nil
+	}
+	// A custom dialer or TLS config keeps net/http from setting up HTTP/2 on its own. Upgrades, which HTTP/2
+	// can't carry, go through an HTTP/1.1 only transport.
+	upgrades := transport(tlsConfig.Clone())
+	if err := http2.ConfigureTransport(t); err != nil {
+		return nil, errors.Wrap(err, "setting up HTTP/2 to the upstream")
+	}
+	return upgradeTransport{RoundTripper: t, upgrades: upgrades}, nil
+}
+
+// upgradeTransport sends requests asking to switch protocols through upgrades.
+type upgradeTransport struct {
+	http.RoundTripper
+	upgrades http.RoundTripper
+}
+
+func (t upgradeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("Upgrade") != "" {
+		return t.upgrades.RoundTrip(r)
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func newUpstreamTLSConfig(config *viper.Viper) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.GetString("upstream_server_name"),
+		InsecureSkipVerify: config.GetBool("upstream_insecure_skip_verify"),
+	}
+
+	if caFile := config.GetString("upstream_ca_file"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading DSC_UPSTREAM_CA_FILE")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile, keyFile := config.GetString("upstream_cert_file"), config.GetString("upstream_key_file")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading the upstream client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,191 @@
+// Package certstore serves the listener certificates through tls.Config.GetCertificate, picking one by SNI and
+// reloading them, along with their OCSP staples, when their files change, so that renewed certificates are
+// served without a restart.
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pair is a certificate and key file, with an optional DER encoded OCSP response stapled to the handshakes.
+type Pair struct {
+	CertFile string
+	KeyFile  string
+	OCSPFile string
+}
+
+// Store holds the certificates loaded from a list of pairs, the first one being served to clients that don't
+// send SNI or ask for an unknown name.
+type Store struct {
+	pairs []Pair
+
+	mu     sync.RWMutex
+	certs  []*tls.Certificate
+	names  map[string]*tls.Certificate
+	stamps []string
+}
+
+// New loads pairs.
+func New(pairs []Pair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	s := &Store{pairs: pairs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParsePairs zips coma separated lists of certificate, key and OCSP response files. The OCSP list may be empty
+// or hold empty entries for certificates without a staple.
+func ParsePairs(certFiles, keyFiles, ocspFiles string) ([]Pair, error) {
+	certs, keys := strings.Split(certFiles, ","), strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, errors.Errorf("got %d certificate files and %d key files", len(certs), len(keys))
+	}
+	var ocsps []string
+	if ocspFiles != "" {
+		ocsps = strings.Split(ocspFiles, ",")
+	}
+	if len(ocsps) > len(certs) {
+		return nil, errors.Errorf("got %d certificate files and %d OCSP files", len(certs), len(ocsps))
+	}
+	pairs := make([]Pair, len(certs))
+	for i := range certs {
+		pairs[i] = Pair{CertFile: strings.TrimSpace(certs[i]), KeyFile: strings.TrimSpace(keys[i])}
+		if i < len(ocsps) {
+			pairs[i].OCSPFile = strings.TrimSpace(ocsps[i])
+		}
+	}
+	return pairs, nil
+}
+
+// stamp identifies a version of a pair's files.
+func stamp(p Pair) string {
+	var parts []string
+	for _, name := range []string{p.CertFile, p.KeyFile, p.OCSPFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return ""
+		}
+		parts = append(parts, fi.ModTime().String(), strconv.FormatInt(fi.Size(), 10))
+	}
+	return strings.Join(parts, "|")
+}
+
+// Reload loads every pair again and swaps them in at once. On error, such as a certificate renewed before its
+// key, the certificates in use are kept.
+func (s *Store) Reload() error {
+	certs := make([]*tls.Certificate, len(s.pairs))
+	names := make(map[string]*tls.Certificate)
+	stamps := make([]string, len(s.pairs))
+	for i, p := range s.pairs {
+		stamps[i] = stamp(p)
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return errors.Wrapf(err, "loading %s", p.CertFile)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.Wrapf(err, "parsing %s", p.CertFile)
+		}
+		cert.Leaf = leaf
+		if p.OCSPFile != "" {
+			if cert.OCSPStaple, err = ioutil.ReadFile(p.OCSPFile); err != nil {
+				return errors.Wrap(err, "loading the OCSP staple")
+			}
+		}
+		certs[i] = &cert
+		for _, name := range append([]string{leaf.Subject.CommonName}, leaf.DNSNames...) {
+			name = strings.ToLower(name)
+			if _, taken := names[name]; name != "" && !taken {
+				names[name] = &cert
+			}
+		}
+	}
+	s.mu.Lock()
+	s.certs, s.names, s.stamps = certs, names, stamps
+	s.mu.Unlock()
+	return nil
+}
+
+// changed tells whether any pair's files changed since they were loaded.
+func (s *Store) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, p := range s.pairs {
+		if stamp(p) != s.stamps[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Match(hello.ServerName), nil
+}
+
+// Match returns the certificate for name, trying an exact match, then a wildcard one, then the default.
+func (s *Store) Match(name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert, ok := s.names[name]; ok {
+		return cert
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.names["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return s.certs[0]
+}
+
+// Certificates returns the certificates in use.
+func (s *Store) Certificates() []*tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*tls.Certificate(nil), s.certs...)
+}
+
+// Covers tells whether a certificate was issued for name, rather than served as the default.
+func (s *Store) Covers(name string) bool {
+	cert := s.Match(name)
+	return cert.Leaf.VerifyHostname(name) == nil
+}
+
+// Watch checks the files every interval and reloads them when they change, until stop is closed. Files are
+// compared by modification time and size, which also catches the symlink swaps of kubernetes secret volumes.
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}, log *logrus.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				log.Error(errors.Wrap(err, "reloading certificates, keeping the previous ones"))
+				continue
+			}
+			log.Info("Reloaded certificates.")
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a self-signed certificate for names to dir, returning its pair.
+func writePair(t *testing.T, dir, prefix string, serial int64, names ...string) Pair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Pair{CertFile: filepath.Join(dir, prefix+".crt"), KeyFile: filepath.Join(dir, prefix+".key")}
+	_ = ioutil.WriteFile(p.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(p.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return p
+}
+
+func TestMatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certstore")
+	defer os.RemoveAll(dir)
+	pairs := []Pair{
+		writePair(t, dir, "default", 1, "dsc.example.com"),
+		writePair(t, dir, "api", 2, "api.example.com"),
+		writePair(t, dir, "wildcard", 3, "*.apps.example.com"),
+	}
+	s, err := New(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]int64{
+		"":                      1,
+		"unknown.example.com":   1,
+		"API.example.com":       2,
+		"shop.apps.example.com": 3,
+	}
+	for name, serial := range cases {
+		cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if got := cert.Leaf.SerialNumber.Int64(); got != serial {
+			t.Errorf("%q got certificate %d want %d", name, got, serial)
+		}
+	}
+	if s.Covers("unknown.example.com") || !s.Covers("shop.apps.example.com") {
+		t.Error("Covers doesn't follow the certificate names")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certstore")
+	defer os.RemoveAll(dir)
+	pair := writePair(t, dir, "dsc", 1, "dsc.example.com")
+	s, err := New([]Pair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(10*time.Millisecond, stop, logrus.New())
+
+	// A certificate without its key is ignored.
+	renewed := writePair(t, dir, "renewed", 2, "dsc.example.com")
+	raw, _ := ioutil.ReadFile(renewed.CertFile)
+	later := time.Now().Add(time.Second)
+	_ = ioutil.WriteFile(pair.CertFile, raw, 0600)
+	_ = os.Chtimes(pair.CertFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+	if got := s.Match("dsc.example.com").Leaf.SerialNumber.Int64(); got != 1 {
+		t.Fatalf("half renewed pair was loaded, serving certificate %d", got)
+	}
+
+	raw, _ = ioutil.ReadFile(renewed.KeyFile)
+	_ = ioutil.WriteFile(pair.KeyFile, raw, 0600)
+	_ = os.Chtimes(pair.KeyFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+	if got := s.Match("dsc.example.com").Leaf.SerialNumber.Int64(); got != 2 {
+		t.Errorf("renewed pair wasn't loaded, serving certificate %d", got)
+	}
+}
+
+func TestOCSPStaple(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certstore")
+	defer os.RemoveAll(dir)
+	a := writePair(t, dir, "a", 1, "a.example.com")
+	b := writePair(t, dir, "b", 2, "b.example.com")
+	staple := filepath.Join(dir, "a.ocsp")
+	_ = ioutil.WriteFile(staple, []byte("staple"), 0600)
+
+	pairs, err := ParsePairs(a.CertFile+","+b.CertFile, a.KeyFile+","+b.KeyFile, staple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.Match("a.example.com").OCSPStaple); got != "staple" {
+		t.Errorf("a.example.com got staple %q", got)
+	}
+	if got := s.Match("b.example.com").OCSPStaple; got != nil {
+		t.Errorf("b.example.com got staple %q", got)
+	}
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// RequireToken returns a middleware answering a 401 to requests without token as their bearer token, but for
+// the exempt paths. An empty token lets every request through.
+func RequireToken(token string, exempt []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" || bearer(r, token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, path := range exempt {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dsc admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("s3cr3t", []string{"/status"})(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+	}))
+	cases := []struct {
+		path, auth string
+		want       int
+	}{
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer nope", http.StatusUnauthorized},
+		{"/metrics", "Bearer s3cr3t", http.StatusOK},
+		{"/status", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s %q: got status code %v want %v", c.path, c.auth, rr.Code, c.want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewRequestMetrics()
+	env := &Env{Log: logrus.New(), Metrics: metrics, Breaker: NewBreaker(1, time.Minute)}
+	public := metrics.Count(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/denied" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	for _, path := range []string{"/", "/", "/denied"} {
+		public.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	env.Breaker.Record(true)
+
+	rr := httptest.NewRecorder()
+	Handler{env, Metrics}.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`dsc_requests_total{code="200"} 2`,
+		`dsc_requests_total{code="403"} 1`,
+		`dsc_requests_in_flight 0`,
+		`dsc_upstream_breaker_state{state="open"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), line+"\n") {
+			t.Errorf("metrics miss %q:\n%s", line, rr.Body.String())
+		}
+	}
+}
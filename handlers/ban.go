@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/throttled/throttled"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	banPrefix    = "dsc:ban:"
+	banLenPrefix = "dsc:banlen:"
+	failPrefix   = "dsc:fail:"
+)
+
+// PenaltyBox bans clients that repeatedly fail dscv validation. Failures are counted with a GCRA limiter so
+// that the N failures allowed per window drain over time, and the ban state lives in the same store used for
+// throttling; bans are therefore shared across instances when the store is redis.
+type PenaltyBox struct {
+	store      throttled.GCRAStore
+	failures   *throttled.GCRARateLimiter
+	BanTime    time.Duration
+	MaxBanTime time.Duration
+	mu         sync.Mutex
+	// seen maps the clients banned as far as this instance knows to their ban expiry.
+	seen map[string]time.Time
+	// prune is the number of clients in seen past which expired bans are forgotten.
+	prune int
+}
+
+// minBanPrune is the smallest number of remembered clients expired bans start being forgotten at.
+const minBanPrune = 1024
+
+// Ban is the json representation of a banned client.
+type Ban struct {
+	Client  string    `json:"client"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewPenaltyBox returns a PenaltyBox that bans a client for banTime after maxFailures failures within window,
+// doubling the ban for repeat offenders up to maxBanTime.
+func NewPenaltyBox(store throttled.GCRAStore, maxFailures int, window, banTime, maxBanTime time.Duration) (*PenaltyBox, error) {
+	if maxFailures < 1 {
+		return nil, errors.New("max failures must be greater than zero")
+	}
+	if window <= 0 || banTime <= 0 {
+		return nil, errors.New("ban window and ban time must be positive durations")
+	}
+	if maxBanTime < banTime {
+		maxBanTime = banTime
+	}
+	quota := throttled.RateQuota{MaxRate: PerDuration(maxFailures, window), MaxBurst: maxFailures - 1}
+	limiter, err := throttled.NewGCRARateLimiter(store, quota)
+	if err != nil {
+		return nil, err
+	}
+	return &PenaltyBox{
+		store:      store,
+		failures:   limiter,
+		BanTime:    banTime,
+		MaxBanTime: maxBanTime,
+		seen:       make(map[string]time.Time),
+		prune:      minBanPrune,
+	}, nil
+}
+
+// Banned reports whether client is currently banned and for how long.
+func (p *PenaltyBox) Banned(client string) (bool, time.Duration, error) {
+	expires, now, err := p.store.GetWithTime(banPrefix + client)
+	if err != nil {
+		return false, 0, err
+	}
+	if expires <= now.UnixNano() {
+		return false, 0, nil
+	}
+	p.remember(client, time.Unix(0, expires), now)
+	return true, time.Duration(expires - now.UnixNano()), nil
+}
+
+// Fail records a validation failure for client and bans it once the failure budget is exhausted. It returns
+// the length of the ban issued, or zero if the client is not banned by this failure.
+func (p *PenaltyBox) Fail(client string) (time.Duration, error) {
+	limited, res, err := p.failures.RateLimit(failPrefix+client, 1)
+	if err != nil || (!limited && res.Remaining > 0) {
+		return 0, err
+	}
+
+	last, now, err := p.store.GetWithTime(banLenPrefix + client)
+	if err != nil {
+		return 0, err
+	}
+	previous, _, err := p.store.GetWithTime(banPrefix + client)
+	if err != nil {
+		return 0, err
+	}
+
+	// Repeat offenders, whose last ban ended less than MaxBanTime ago, get twice their previous ban.
+	ban := p.BanTime
+	if last > 0 && previous > 0 && now.UnixNano()-previous < int64(p.MaxBanTime) {
+		ban = time.Duration(last) * 2
+	}
+	if ban > p.MaxBanTime {
+		ban = p.MaxBanTime
+	}
+
+	ttl := ban + p.MaxBanTime
+	if err := storeSet(p.store, banLenPrefix+client, int64(ban), ttl); err != nil {
+		return 0, err
+	}
+	if err := storeSet(p.store, banPrefix+client, now.Add(ban).UnixNano(), ttl); err != nil {
+		return 0, err
+	}
+	p.remember(client, now.Add(ban), now)
+	return ban, nil
+}
+
+// Lift removes the ban on client and forgets its failures and escalation history.
+func (p *PenaltyBox) Lift(client string) error {
+	for _, prefix := range []string{banPrefix, banLenPrefix, failPrefix} {
+		if err := storeSet(p.store, prefix+client, 0, time.Second); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	delete(p.seen, client)
+	p.mu.Unlock()
+	return nil
+}
+
+// List returns the bans issued or observed by this instance that are still in force.
+func (p *PenaltyBox) List() ([]Ban, error) {
+	p.mu.Lock()
+	clients := make([]string, 0, len(p.seen))
+	for c := range p.seen {
+		clients = append(clients, c)
+	}
+	p.mu.Unlock()
+	sort.Strings(clients)
+
+	bans := []Ban{}
+	for _, c := range clients {
+		expires, now, err := p.store.GetWithTime(banPrefix + c)
+		if err != nil {
+			return nil, err
+		}
+		if expires <= now.UnixNano() {
+			p.mu.Lock()
+			delete(p.seen, c)
+			p.mu.Unlock()
+			continue
+		}
+		bans = append(bans, Ban{Client: c, Expires: time.Unix(0, expires).UTC()})
+	}
+	return bans, nil
+}
+
+// remember records the ban of client until expires. Whenever the remembered clients double, the expired bans are
+// forgotten, which keeps seen bounded when List is never called.
+func (p *PenaltyBox) remember(client string, expires, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seen[client] = expires
+	if len(p.seen) < p.prune {
+		return
+	}
+	for c, e := range p.seen {
+		if !e.After(now) {
+			delete(p.seen, c)
+		}
+	}
+	p.prune = 2 * len(p.seen)
+	if p.prune < minBanPrune {
+		p.prune = minBanPrune
+	}
+}
+
+// PerDuration approximates a throttled.Rate of n events per period using the coarsest constructor that fits,
+// as throttled.Rate can't be built from an arbitrary period.
+func PerDuration(n int, period time.Duration) throttled.Rate {
+	interval := period / time.Duration(n)
+	units := []struct {
+		d time.Duration
+		f func(int) throttled.Rate
+	}{
+		{time.Second, throttled.PerSec},
+		{time.Minute, throttled.PerMin},
+		{time.Hour, throttled.PerHour},
+		{24 * time.Hour, throttled.PerDay},
+	}
+	for _, u := range units {
+		if interval > 0 && interval <= u.d {
+			return u.f(int(u.d / interval))
+		}
+	}
+	return throttled.PerDay(1)
+}
+
+// storeSet unconditionally sets key to value in a GCRAStore, which only offers set-if-not-exists and
+// compare-and-swap primitives.
+func storeSet(store throttled.GCRAStore, key string, value int64, ttl time.Duration) error {
+	for i := 0; i < 10; i++ {
+		old, _, err := store.GetWithTime(key)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if old == -1 {
+			ok, err = store.SetIfNotExistsWithTTL(key, value, ttl)
+		} else {
+			ok, err = store.CompareAndSwapWithTTL(key, old, value, ttl)
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("could not update %s after concurrent modifications", key)
+}
+
+// checkBan rejects requests coming from banned clients.
+func checkBan(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if env.Bans == nil {
+		return nil
+	}
+	client := ClientIP(r)
+	banned, left, err := env.Bans.Banned(client)
+	if err != nil {
+		requestLog(env.Log, r).WithFields(logrus.Fields{"client": client}).Error(err)
+		return nil
+	}
+	if banned {
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false", "client": client}).Warn("Banned client.")
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(left.Seconds()))))
+		return StatusError{403, errors.New("client banned")}
+	}
+	return nil
+}
+
+// recordFailure charges a validation failure to the client of r.
+func recordFailure(env *Env, r *http.Request) {
+	if env.Bans == nil {
+		return
+	}
+	client := ClientIP(r)
+	ban, err := env.Bans.Fail(client)
+	if err != nil {
+		requestLog(env.Log, r).WithFields(logrus.Fields{"client": client}).Error(err)
+		return
+	}
+	if ban > 0 {
+		requestLog(env.Log, r).WithFields(logrus.Fields{"client": client, "ban": ban.String()}).Warn("Client banned.")
+	}
+}
+
+func checkAdmin(env *Env, r *http.Request) error {
+	if !bearer(r, env.AdminToken) {
+		return StatusError{401, errors.New("unauthorized")}
+	}
+	return nil
+}
+
+// bearer tells whether r carries token as its bearer token, an empty token never matches.
+func bearer(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// Bans is an admin http handler which lists active bans on GET and lifts the ban on the client query
+// string value on DELETE.
+func Bans(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if err := checkAdmin(env, r); err != nil {
+		return err
+	}
+	return AdminBans(env, w, r)
+}
+
+// AdminBans is Bans without the token check, for the admin listener which authenticates requests on its own.
+func AdminBans(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if env.Bans == nil {
+		return StatusError{404, errors.New("bans are disabled")}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		bans, err := env.Bans.List()
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(bans)
+	case http.MethodDelete:
+		client := r.URL.Query().Get("client")
+		if client == "" {
+			return StatusError{400, errors.New("missing client")}
+		}
+		if err := env.Bans.Lift(client); err != nil {
+			return err
+		}
+		requestLog(env.Log, r).WithFields(logrus.Fields{"client": client}).Info("Ban lifted.")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return StatusError{405, errors.New("method not allowed")}
+}
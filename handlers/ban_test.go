@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"github.com/throttled/throttled/store/memstore"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPenaltyBox(t *testing.T) {
+	store, _ := memstore.New(0)
+	bans, err := NewPenaltyBox(store, 3, time.Minute, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both", Bans: bans}
+	handler := http.Handler(Handler{&env, JudgeW})
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/foo/var?dscv=bogus", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			t.Fatalf("bogus dscv was accepted")
+		}
+	}
+
+	// A valid token is refused while the client is banned.
+	u1, _ := uuid.NewUUID()
+	hmac := url.QueryEscape(CreateMAC(&u1, []byte("123")))
+	req, _ := http.NewRequest("GET", "/foo/var?dscv="+u1.String()+"&hmac="+hmac, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("banned client got status code: got %v want %v", status, http.StatusForbidden)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("missing Retry-After header on banned response")
+	}
+
+	list, _ := bans.List()
+	if len(list) != 1 || list[0].Client != "10.0.0.1" {
+		t.Fatalf("unexpected ban list: %v", list)
+	}
+
+	if err := bans.Lift("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("lifted client got status code: got %v want %v", status, http.StatusOK)
+	}
+	if ban, err := bans.Fail("10.0.0.1"); err != nil || ban != 0 {
+		t.Errorf("lifted client was banned again on its first failure: %v, %v", ban, err)
+	}
+}
+
+func TestPenaltyBoxForgetsExpiredBans(t *testing.T) {
+	store, _ := memstore.New(0)
+	bans, _ := NewPenaltyBox(store, 1, time.Minute, time.Minute, time.Hour)
+	now := time.Now()
+	for i := 0; i < 10*minBanPrune; i++ {
+		bans.remember("10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256), now, now)
+	}
+	if len(bans.seen) > minBanPrune {
+		t.Errorf("expired bans are still remembered: got %d, want at most %d", len(bans.seen), minBanPrune)
+	}
+}
+
+func TestPenaltyBoxEscalation(t *testing.T) {
+	store, _ := memstore.New(0)
+	bans, _ := NewPenaltyBox(store, 1, time.Minute, time.Minute, 3*time.Minute)
+
+	var got []time.Duration
+	for i := 0; i < 3; i++ {
+		ban, err := bans.Fail("10.0.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ban)
+	}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ban %d: got %v want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBansAdmin(t *testing.T) {
+	store, _ := memstore.New(0)
+	bans, _ := NewPenaltyBox(store, 1, time.Minute, time.Minute, time.Hour)
+	env := Env{Log: logrus.New(), Bans: bans, AdminToken: "s3cr3t"}
+	handler := http.Handler(Handler{&env, Bans})
+
+	req, _ := http.NewRequest("GET", "/_dsc/bans", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	req.Header.Set("Authorization", "s3cr3t")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("token without the Bearer scheme got status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
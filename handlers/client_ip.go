@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"github.com/throttled/throttled"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// client is what TrustedProxies learns about the sender of a request.
+type client struct {
+	ip string
+	// proxied is set when the request comes straight from a trusted proxy.
+	proxied bool
+}
+
+// TrustedProxies returns a middleware resolving the client address of every request. X-Forwarded-For and
+// X-Real-IP are only honoured when the request comes straight from one of the trusted networks, otherwise
+// anybody could pick the address bans, throttles and logs see. With strip set, the Forwarded, X-Forwarded-* and
+// X-Real-IP headers of other requests are dropped before anything reads them, upstream included.
+func TrustedProxies(trusted []*net.IPNet, strip bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := client{proxied: fromNetworks(r, trusted)}
+			if strip && !c.proxied {
+				for _, h := range forwardedHeaders {
+					r.Header.Del(h)
+				}
+			}
+			c.ip = resolveClientIP(r, trusted)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, c)))
+		})
+	}
+}
+
+// ClientIP returns the client address resolved by TrustedProxies, or r's peer address when it didn't run.
+func ClientIP(r *http.Request) string {
+	if c, ok := r.Context().Value(clientIPKey{}).(client); ok {
+		return c.ip
+	}
+	return remoteHost(r)
+}
+
+// Proxied tells whether r comes straight from one of the trusted proxies, false when TrustedProxies didn't run.
+func Proxied(r *http.Request) bool {
+	c, _ := r.Context().Value(clientIPKey{}).(client)
+	return c.proxied
+}
+
+// VaryByClient keys throttles on the ClientIP of requests, and their path when path is set, so that forged
+// forwarding headers don't get a client a fresh quota.
+func VaryByClient(path bool) *throttled.VaryBy {
+	return &throttled.VaryBy{Custom: func(r *http.Request) string {
+		if path {
+			return ClientIP(r) + "\n" + r.URL.Path
+		}
+		return ClientIP(r)
+	}}
+}
+
+// resolveClientIP walks X-Forwarded-For from the right, skipping the trusted proxies, and returns the first
+// address they didn't add themselves. X-Real-IP is used when there's no X-Forwarded-For.
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+	remote := remoteHost(r)
+	if !inNetworks(net.ParseIP(remote), trusted) {
+		return remote
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			client = ip.String()
+			if !inNetworks(ip, trusted) {
+				break
+			}
+		}
+		return client
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return remote
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	trusted, err := ParseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client string
+	handler := TrustedProxies(trusted, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = ClientIP(r)
+	}))
+
+	cases := []struct {
+		remote, xff, realIP, want string
+	}{
+		{"198.51.100.7:4711", "192.0.2.1", "", "198.51.100.7"},
+		{"198.51.100.7:4711", "", "192.0.2.1", "198.51.100.7"},
+		{"10.0.0.1:4711", "192.0.2.1", "", "192.0.2.1"},
+		{"10.0.0.1:4711", "203.0.113.9, 192.0.2.1, 10.0.0.2", "", "192.0.2.1"},
+		{"10.0.0.1:4711", "not-an-ip, 192.0.2.1", "", "192.0.2.1"},
+		{"10.0.0.1:4711", "10.0.0.3", "", "10.0.0.3"},
+		{"10.0.0.1:4711", "", "192.0.2.1", "192.0.2.1"},
+		{"10.0.0.1:4711", "", "", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.realIP != "" {
+			req.Header.Set("X-Real-IP", c.realIP)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if client != c.want {
+			t.Errorf("%s xff %q real ip %q: got %q want %q", c.remote, c.xff, c.realIP, client, c.want)
+		}
+	}
+}
+
+func TestForgedForwardedForIsNotBanned(t *testing.T) {
+	store, _ := memstore.New(0)
+	bans, err := NewPenaltyBox(store, 2, time.Minute, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both", Bans: bans}
+	handler := TrustedProxies(nil, false)(Handler{&env, JudgeW})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/foo?dscv=bogus", nil)
+		req.RemoteAddr = "198.51.100.7:4711"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	list, _ := bans.List()
+	if len(list) != 1 || list[0].Client != "198.51.100.7" {
+		t.Fatalf("unexpected ban list: %v", list)
+	}
+}
+
+func TestTrustedProxiesStrip(t *testing.T) {
+	trusted, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	var seen http.Header
+	var client string
+	handler := TrustedProxies(trusted, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, client = r.Header, ClientIP(r)
+	}))
+
+	for _, c := range []struct {
+		remote string
+		kept   bool
+	}{{"198.51.100.7:4711", false}, {"10.0.0.1:4711", true}} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		for _, h := range forwardedHeaders {
+			req.Header.Set(h, "192.0.2.1")
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		for _, h := range forwardedHeaders {
+			if got := seen.Get(h) != ""; got != c.kept {
+				t.Errorf("%s %s: kept %v want %v", c.remote, h, got, c.kept)
+			}
+		}
+		if want := map[bool]string{false: "198.51.100.7", true: "192.0.2.1"}[c.kept]; client != want {
+			t.Errorf("%s: client %q want %q", c.remote, client, want)
+		}
+	}
+}
+
+func TestThrottleIgnoresForgedForwardedFor(t *testing.T) {
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: 0})
+	denied, _ := NewDeniedResponse("text", "", "")
+	th := Throttle{RateLimiter: limiter, VaryBy: VaryByClient(true), Denied: denied, Log: logrus.New()}
+	handler := TrustedProxies(nil, false)(th.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "198.51.100.7:4711"
+		req.Header.Set("X-Forwarded-For", "192.0.2."+strconv.Itoa(i))
+		req.Header.Set("X-Real-IP", "192.0.2."+strconv.Itoa(i))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("request %d got status code: got %v want %v", i, rr.Code, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"github.com/pkg/errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LimitAlgorithm computes a new concurrency limit from an upstream round trip sample. dropped is true when the
+// upstream failed or timed out.
+type LimitAlgorithm interface {
+	Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64
+}
+
+// FixedLimit never changes the limit.
+type FixedLimit struct{}
+
+// Update returns limit unchanged.
+func (FixedLimit) Update(limit float64, _ time.Duration, _ int, _ bool) float64 { return limit }
+
+// GradientLimit adjusts the limit by the ratio between the long term and the current round trip time, in the
+// spirit of Netflix's gradient2 limiter: a slowing upstream shrinks the limit while sqrt(limit) of headroom lets
+// it grow back.
+type GradientLimit struct {
+	longRTT float64
+}
+
+// Update implements LimitAlgorithm.
+func (g *GradientLimit) Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	sample := float64(rtt)
+	if g.longRTT == 0 {
+		g.longRTT = sample
+	}
+	g.longRTT = g.longRTT*0.95 + sample*0.05
+
+	// Don't grow while the limit isn't being used.
+	if float64(inflight) < limit/2 && !dropped {
+		return limit
+	}
+	gradient := math.Max(0.5, math.Min(1.0, g.longRTT/sample))
+	if dropped {
+		gradient = 0.5
+	}
+	next := limit*gradient + math.Sqrt(limit)
+	return limit*0.8 + next*0.2
+}
+
+// VegasLimit estimates the upstream queue from the minimum observed round trip time, as TCP Vegas does, and
+// grows the limit while the queue is short, shrinking it when it builds up.
+type VegasLimit struct {
+	noLoadRTT float64
+}
+
+// Update implements LimitAlgorithm.
+func (v *VegasLimit) Update(limit float64, rtt time.Duration, inflight int, dropped bool) float64 {
+	sample := float64(rtt)
+	if v.noLoadRTT == 0 || sample < v.noLoadRTT {
+		v.noLoadRTT = sample
+	}
+	step := math.Max(1, math.Log10(limit))
+	if dropped {
+		return limit - step
+	}
+	if float64(inflight)*2 < limit {
+		return limit
+	}
+	queue := limit * (1 - v.noLoadRTT/sample)
+	switch {
+	case queue <= 3*step:
+		return limit + step
+	case queue >= 6*step:
+		return limit - step
+	}
+	return limit
+}
+
+// NewLimitAlgorithm returns the LimitAlgorithm called name.
+func NewLimitAlgorithm(name string) (LimitAlgorithm, error) {
+	switch name {
+	case "fixed":
+		return FixedLimit{}, nil
+	case "gradient":
+		return &GradientLimit{}, nil
+	case "vegas":
+		return &VegasLimit{}, nil
+	}
+	return nil, errors.Errorf("unknown concurrency algorithm %q", name)
+}
+
+// ConcurrencyLimiter caps in-flight upstream requests to an adaptive limit, parking the excess in a bounded
+// queue for up to QueueTimeout.
+type ConcurrencyLimiter struct {
+	mu           sync.Mutex
+	algorithm    LimitAlgorithm
+	limit        float64
+	minLimit     float64
+	maxLimit     float64
+	inflight     int
+	queue        *list.List
+	maxQueue     int
+	QueueTimeout time.Duration
+}
+
+// NewConcurrencyLimiter returns a ConcurrencyLimiter starting at limit, kept within [1, maxLimit].
+func NewConcurrencyLimiter(algorithm LimitAlgorithm, limit, maxLimit, maxQueue int, queueTimeout time.Duration) *ConcurrencyLimiter {
+	if maxLimit < limit {
+		maxLimit = limit
+	}
+	return &ConcurrencyLimiter{
+		algorithm:    algorithm,
+		limit:        float64(limit),
+		minLimit:     1,
+		maxLimit:     float64(maxLimit),
+		queue:        list.New(),
+		maxQueue:     maxQueue,
+		QueueTimeout: queueTimeout,
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (c *ConcurrencyLimiter) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.limit)
+}
+
+// Acquire reserves a slot, waiting in the queue if needed. It returns false when the request should be shed,
+// otherwise the returned func must be called with the outcome once the upstream has answered.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context) (func(dropped bool), bool) {
+	c.mu.Lock()
+	if c.inflight < int(c.limit) {
+		c.inflight++
+		c.mu.Unlock()
+		return c.release(time.Now()), true
+	}
+	if c.queue.Len() >= c.maxQueue {
+		c.mu.Unlock()
+		return nil, false
+	}
+	ready := make(chan struct{})
+	elem := c.queue.PushBack(ready)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(c.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return c.release(time.Now()), true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-ready:
+		// Granted while timing out, hand the slot back.
+		c.inflight--
+		c.dispatch()
+	default:
+		c.queue.Remove(elem)
+	}
+	return nil, false
+}
+
+func (c *ConcurrencyLimiter) release(start time.Time) func(bool) {
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			rtt := time.Since(start)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			limit := c.algorithm.Update(c.limit, rtt, c.inflight, dropped)
+			c.limit = math.Max(c.minLimit, math.Min(c.maxLimit, limit))
+			c.inflight--
+			c.dispatch()
+		})
+	}
+}
+
+// dispatch hands free slots to queued requests, c.mu must be held.
+func (c *ConcurrencyLimiter) dispatch() {
+	for c.inflight < int(c.limit) && c.queue.Len() > 0 {
+		ready := c.queue.Remove(c.queue.Front()).(chan struct{})
+		c.inflight++
+		close(ready)
+	}
+}
+
+// statusWriter records the status code written to an http.ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	// idle and lifetime bound upgraded connections, tracked by upgrades.
+	idle     time.Duration
+	lifetime time.Duration
+	upgrades *Upgrades
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed upstream responses through.
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serveUpstream forwards r to the upstream within the route's concurrency limit.
+func serveUpstream(env *Env, w *statusWriter, r *http.Request) error {
+	limiter, _ := env.Concurrency.Match(r.URL.Path).(*ConcurrencyLimiter)
+	// Upgraded connections would hold a slot for their whole life.
+	if limiter == nil || isUpgrade(r) {
+		env.Proxy.ServeHTTP(w, r)
+		return nil
+	}
+	done, ok := limiter.Acquire(r.Context())
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		return StatusError{503, errors.New("upstream overloaded, request shed")}
+	}
+	defer func() { done(w.status == http.StatusBadGateway || w.status == http.StatusGatewayTimeout) }()
+	env.Proxy.ServeHTTP(w, r)
+	return nil
+}
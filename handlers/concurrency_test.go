@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterShed(t *testing.T) {
+	l := NewConcurrencyLimiter(FixedLimit{}, 1, 1, 1, 50*time.Millisecond)
+
+	done, ok := l.Acquire(context.Background())
+	if !ok {
+		t.Fatal("first request was shed")
+	}
+
+	granted := make(chan bool)
+	go func() {
+		release, ok := l.Acquire(context.Background())
+		if ok {
+			release(false)
+		}
+		granted <- ok
+	}()
+
+	// The queue holds a single request, a third one is shed right away.
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := l.Acquire(context.Background()); ok {
+		t.Error("request beyond the queue was not shed")
+	}
+
+	done(false)
+	if !<-granted {
+		t.Error("queued request was not granted after release")
+	}
+
+	done, _ = l.Acquire(context.Background())
+	if _, ok := l.Acquire(context.Background()); ok {
+		t.Error("queued request was granted past its timeout")
+	}
+	done(false)
+}
+
+func TestGradientLimitBacksOff(t *testing.T) {
+	g := &GradientLimit{}
+	limit := 20.0
+	for i := 0; i < 50; i++ {
+		limit = g.Update(limit, 10*time.Millisecond, int(limit), false)
+	}
+	steady := limit
+	for i := 0; i < 20; i++ {
+		limit = g.Update(limit, 200*time.Millisecond, int(limit), false)
+	}
+	if limit >= steady {
+		t.Errorf("limit did not shrink on a slow upstream: %f >= %f", limit, steady)
+	}
+}
+
+func TestVegasLimitDrop(t *testing.T) {
+	v := &VegasLimit{}
+	if got := v.Update(20, 10*time.Millisecond, 20, true); got >= 20 {
+		t.Errorf("limit did not shrink on a dropped request: %f", got)
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const mebibyte = 1 << 20
+
+// Costs weights requests for the throttle by method and path prefix, and optionally by body size.
+type Costs struct {
+	byMethod map[string]*Routes
+	max      int
+	// BodyCost is charged for every started MiB of request body, upfront when its length is declared and once
+	// it's read otherwise.
+	BodyCost int
+}
+
+// ParseCosts parses a coma separated list of "[METHOD ]/prefix=cost" pairs, ie "POST /upload=10,/search=2".
+func ParseCosts(spec string, bodyCost int) (*Costs, error) {
+	c := &Costs{byMethod: make(map[string]*Routes), max: 1, BodyCost: bodyCost}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		fields := strings.Fields(kv[0])
+		if len(kv) != 2 || len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.Errorf("bad throttle cost %q, want [METHOD ]/prefix=cost", pair)
+		}
+		method, prefix := "", fields[0]
+		if len(fields) == 2 {
+			method, prefix = strings.ToUpper(fields[0]), fields[1]
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, errors.Errorf("bad throttle cost %q, want [METHOD ]/prefix=cost", pair)
+		}
+		cost, err := strconv.Atoi(kv[1])
+		if err != nil || cost < 0 {
+			return nil, errors.Errorf("bad throttle cost %q, cost must be a non-negative integer", pair)
+		}
+		if c.byMethod[method] == nil {
+			c.byMethod[method] = &Routes{}
+		}
+		c.byMethod[method].Add(prefix, cost)
+		if cost > c.max {
+			c.max = cost
+		}
+	}
+	return c, nil
+}
+
+// Max returns the highest configured route cost.
+func (c *Costs) Max() int {
+	if c == nil {
+		return 1
+	}
+	return c.max
+}
+
+// Cost returns the quantity charged to the throttle for r, a method specific cost wins over a generic one and
+// unlisted routes cost one.
+func (c *Costs) Cost(r *http.Request) int {
+	if c == nil {
+		return 1
+	}
+	cost, ok := c.byMethod[r.Method].Match(r.URL.Path).(int)
+	if !ok {
+		cost, ok = c.byMethod[""].Match(r.URL.Path).(int)
+	}
+	if !ok {
+		cost = 1
+	}
+	if r.ContentLength > 0 {
+		cost += c.Body(r.ContentLength)
+	}
+	return cost
+}
+
+// Body returns the cost of n bytes of request body.
+func (c *Costs) Body(n int64) int {
+	if c == nil || c.BodyCost <= 0 || n <= 0 {
+		return 0
+	}
+	return c.BodyCost * int((n+mebibyte-1)/mebibyte)
+}
+
+// unmetered tells whether r has a body of unknown length, ie a chunked upload, which Cost can't charge upfront.
+func (c *Costs) unmetered(r *http.Request) bool {
+	return c != nil && c.BodyCost > 0 && r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
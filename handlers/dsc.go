@@ -9,10 +9,12 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -51,6 +53,29 @@ type Env struct {
 	Log          *logrus.Logger
 	CustomHeader string
 	Proto        string
+	Bans         *PenaltyBox
+	AdminToken   string
+	Concurrency  *Routes
+	Responses    *ResponseThrottle
+	// KeepDSCParams forwards the dscv and hmac values, cookie and X-DSC-* headers to the upstream.
+	KeepDSCParams bool
+	// UpstreamHeaders are applied to requests forwarded upstream.
+	UpstreamHeaders []HeaderRule
+	// WebSocketIdleTimeout and WebSocketMaxLifetime bound upgraded connections, zero means no bound.
+	WebSocketIdleTimeout time.Duration
+	WebSocketMaxLifetime time.Duration
+	// Breaker is the upstream circuit breaker, if any, reported by Status.
+	Breaker *Breaker
+	// Upgrades tracks proxied websockets, to drain them on shutdown.
+	Upgrades *Upgrades
+	// Readiness turns Status and Ready into a 503 once shutdown starts.
+	Readiness *Readiness
+	// Health holds the dependency checks of the readiness probe.
+	Health *HealthChecks
+	// Metrics counts the requests served, exposed on the admin listener.
+	Metrics *RequestMetrics
+	// IdentityRules let clients with matching certificates skip the dscv check.
+	IdentityRules []IdentityRule
 }
 
 // Handler is a wrapper to satisfy http.Handler and to pass around an *Env context.
@@ -67,18 +92,27 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case Error:
 			// We can retrieve the status here and write out a specific
 			// HTTP status code.
-			h.Env.Log.Printf("HTTP %d - %s", e.Status(), e)
+			requestLog(h.Env.Log, r).Printf("HTTP %d - %s", e.Status(), e)
 
-			http.Error(w, e.Error(), e.Status())
+			http.Error(w, withRequestID(e.Error(), r), e.Status())
 		default:
 			// Any error types we don't specifically look out for default
 			// to serving a HTTP 500
-			http.Error(w, http.StatusText(http.StatusInternalServerError),
+			requestLog(h.Env.Log, r).Error(err)
+			http.Error(w, withRequestID(http.StatusText(http.StatusInternalServerError), r),
 				http.StatusInternalServerError)
 		}
 	}
 }
 
+// withRequestID appends r's ID to an error body, for clients to quote it.
+func withRequestID(body string, r *http.Request) string {
+	if id := RequestID(r); id != "" {
+		return body + "\nrequest id: " + id
+	}
+	return body
+}
+
 // CheckMAC verifies an hmac for a given message and key.
 func CheckMAC(message, messageMAC, key []byte) bool {
 	mac := hmac.New(sha256.New, key)
@@ -108,6 +142,9 @@ type dscv struct {
 //Dsservice creates a time based uuid1 and sets a secure cookie with its hmac, i also returns a json representation
 //of the hmac'ed value in its URL-encoded form.
 func Dsservice(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if err := checkBan(env, w, r); err != nil {
+		return err
+	}
 	u1, err := uuid.NewUUID()
 	if err != nil {
 		logrus.Fatal(err)
@@ -126,52 +163,98 @@ func Dsservice(env *Env, w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Content-Type", "application/json")
 	encerr := json.NewEncoder(w).Encode(jsOut)
 	if encerr != nil {
-		env.Log.Error(err)
+		requestLog(env.Log, r).Error(err)
 		panic(err)
 	}
 	return nil
 }
 
-// Judge tests, hmac and uuid values.
+// Validation describes an accepted dscv, it's the data handed to upstream header templates.
+type Validation struct {
+	UUID   string
+	Age    int64
+	TTL    int64
+	Client string
+	// Mode is "cookie" or "url", depending on where the hmac was found, or "mtls" for clients trusted by their
+	// certificate.
+	Mode  string
+	Proto string
+	// Scope is the host the hmac cookie was issued for in cookie mode, and empty in url and mtls modes whose
+	// tokens aren't bound to a host.
+	Scope string
+	// Identity is the client certificate identity, if any.
+	Identity string
+}
+
+// Judge tests, hmac and uuid values, charging failures to the client's penalty box.
 func Judge(env *Env, w http.ResponseWriter, r *http.Request) error {
+	_, err := validate(env, w, r)
+	return err
+}
+
+func validate(env *Env, w http.ResponseWriter, r *http.Request) (*Validation, error) {
+	if err := checkBan(env, w, r); err != nil {
+		return nil, err
+	}
+	var identity string
+	if id := Identity(r); id != nil {
+		identity = id.String()
+	}
+	if skipsDSCV(env.IdentityRules, r) {
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "true", "identity": identity}).Info(
+			"Client certificate trusted, skipping dscv.")
+		return &Validation{Client: ClientIP(r), Mode: "mtls", Proto: env.Proto, Identity: identity}, nil
+	}
+	v, err := judge(env, w, r)
+	if err != nil {
+		recordFailure(env, r)
+		return nil, err
+	}
+	v.Identity = identity
+	return v, nil
+}
+
+func judge(env *Env, w http.ResponseWriter, r *http.Request) (*Validation, error) {
 
 	var dscv string
+	mode := "cookie"
 
 	c, err := r.Cookie("hmac")
 	if err != nil {
 		if env.Proto != "both" {
-			env.Log.WithFields(logrus.Fields{"granted": "false"}).Warn("No hmac cookie found.")
-			return StatusError{500, errors.New("bad dscv; no cookie present in request")}
+			requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false"}).Warn("No hmac cookie found.")
+			return nil, StatusError{500, errors.New("bad dscv; no cookie present in request")}
 
 		}
 		raw := r.URL.Query().Get("hmac")
 		h, err1 := url.PathUnescape(raw)
 		if err1 != nil || raw == "" {
-			env.Log.WithFields(logrus.Fields{"granted": "false"}).Warn("No hmac query string.")
-			return StatusError{500, errors.New("Bad dscv; no named cookie, nor hmac" +
+			requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false"}).Warn("No hmac query string.")
+			return nil, StatusError{500, errors.New("Bad dscv; no named cookie, nor hmac" +
 				" query string.")}
 		}
 		dscv = h
+		mode = "url"
 	} else {
 		dscv = c.Value
 	}
 
-	return checkDSCV(env, dscv, w, r)
+	return checkDSCV(env, dscv, mode, w, r)
 }
 
-func checkDSCV(env *Env, dscv string, w http.ResponseWriter, r *http.Request) error {
+func checkDSCV(env *Env, dscv, mode string, w http.ResponseWriter, r *http.Request) (*Validation, error) {
 	param := r.URL.Query().Get("dscv")
 	u1, err := uuid.Parse(param)
 	if err != nil {
-		env.Log.WithFields(logrus.Fields{"granted": "false"}).Warn(err)
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false"}).Warn(err)
 		// no dscv query param.
-		return StatusError{403, err}
+		return nil, StatusError{403, err}
 	}
 
 	if u1.Version() != 1 && u1.Version() != 2 {
-		env.Log.WithFields(logrus.Fields{"granted": "false"}).Warn("Invalid uuid version")
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false"}).Warn("Invalid uuid version")
 		// not a time based uuid?
-		return errorForbidden
+		return nil, errorForbidden
 	}
 
 	t := u1.Time()
@@ -180,34 +263,70 @@ func checkDSCV(env *Env, dscv string, w http.ResponseWriter, r *http.Request) er
 	secs := now.Unix()
 
 	if (secs - uuidSecs) > env.MaxTime {
-		env.Log.WithFields(logrus.Fields{"granted": "false"}).Warn("Old uud.")
-		return errorForbidden
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false"}).Warn("Old uud.")
+		return nil, errorForbidden
 	}
 	decodedCookie, err := base64.StdEncoding.DecodeString(dscv)
 	if err != nil {
-		env.Log.WithFields(logrus.Fields{"granted": "false", "dscv": dscv, "uuid": u1.String()}).Error(err)
-		return errorForbidden
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false", "dscv": dscv, "uuid": u1.String()}).Error(err)
+		return nil, errorForbidden
 	}
 
 	if CheckMAC([]byte(param), decodedCookie, []byte(env.DSCKey)) {
-		env.Log.WithFields(logrus.Fields{"granted": "true", "address": r.RemoteAddr}).Info("Cookie hmac matches dscv query string.")
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "true", "address": r.RemoteAddr}).Info("Cookie hmac matches dscv query string.")
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("X-DSC-Status", "valid")
 		w.Header().Set("X-DSC-TTL", fmt.Sprintf("%d", env.MaxTime-(secs-uuidSecs)))
-		return nil
+		var scope string
+		if mode == "cookie" {
+			scope = r.Host
+			if h, _, err := net.SplitHostPort(scope); err == nil {
+				scope = h
+			}
+		}
+		return &Validation{
+			UUID:   u1.String(),
+			Age:    secs - uuidSecs,
+			TTL:    env.MaxTime - (secs - uuidSecs),
+			Client: ClientIP(r),
+			Mode:   mode,
+			Proto:  env.Proto,
+			Scope:  scope,
+		}, nil
 	}
-	env.Log.WithFields(logrus.Fields{"granted": "false"}).Warn("Invalid hmac value.")
-	return errorForbidden
+	requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false"}).Warn("Invalid hmac value.")
+	return nil, errorForbidden
 
 }
 
+// Readiness tells whether the instance should keep getting traffic.
+type Readiness struct {
+	draining int32
+}
+
+// Drain marks the instance as not ready.
+func (rd *Readiness) Drain() {
+	atomic.StoreInt32(&rd.draining, 1)
+}
+
+// Draining tells whether Drain was called.
+func (rd *Readiness) Draining() bool {
+	return rd != nil && atomic.LoadInt32(&rd.draining) == 1
+}
+
 // Status is an http hangler used as a health/readiness check in k8s and openshift.
 func Status(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if env.Readiness.Draining() {
+		return StatusError{503, errors.New("shutting down")}
+	}
 	_, err := w.Write([]byte("OK\n"))
 	if err != nil {
 		return err
 	}
-	return nil
+	if env.Breaker != nil {
+		_, err = fmt.Fprintf(w, "upstream breaker: %s\n", env.Breaker.State())
+	}
+	return err
 
 }
 
@@ -219,7 +338,7 @@ func JudgeW(env *Env, w http.ResponseWriter, r *http.Request) error {
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		env.Log.Debugf("JudgeW wrote %n bytes", n)
+		requestLog(env.Log, r).Debugf("JudgeW wrote %d bytes", n)
 	}
 	return shouldRoute
 
@@ -228,15 +347,31 @@ func JudgeW(env *Env, w http.ResponseWriter, r *http.Request) error {
 // ProxyHandler sends http requests to upstream if Judge calls finds a match between uuid and hmac (in cookie
 // or url modes depending on DSC_PROTO.)
 func ProxyHandler(env *Env, w http.ResponseWriter, r *http.Request) error {
-	shouldRoute := Judge(env, w, r)
+	validation, shouldRoute := validate(env, w, r)
 	if shouldRoute != nil {
 		return shouldRoute
 	}
+	charge, allowed, err := env.Responses.Check(env, w, r)
+	if !allowed {
+		return err
+	}
+	if !env.KeepDSCParams {
+		stripDSC(r)
+	}
 	if env.CustomHeader != "" {
-		values := strings.Split(env.CustomHeader, ":")
-		r.Header.Add(values[0], values[1])
+		if values := strings.SplitN(env.CustomHeader, ":", 2); len(values) == 2 {
+			r.Header.Add(values[0], values[1])
+		}
 	}
-	env.Log.WithFields(logrus.Fields{"path": r.URL}).Info("Forwarding url to upstream.")
-	env.Proxy.ServeHTTP(w, r)
-	return nil
+	if err := applyHeaderRules(env.UpstreamHeaders, r.Header, r.URL.Path, validation); err != nil {
+		return err
+	}
+	requestLog(env.Log, r).WithFields(logrus.Fields{"path": r.URL}).Info("Forwarding url to upstream.")
+	sw := &statusWriter{ResponseWriter: w, idle: env.WebSocketIdleTimeout, lifetime: env.WebSocketMaxLifetime,
+		upgrades: env.Upgrades}
+	err = serveUpstream(env, sw, r)
+	if charge != nil {
+		charge(sw.status)
+	}
+	return err
 }
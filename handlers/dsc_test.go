@@ -229,6 +229,19 @@ func TestStatus(t *testing.T) {
 	}
 }
 
+func TestStatusDraining(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/_dsc/status", nil)
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Readiness: &Readiness{}}
+	env.Readiness.Drain()
+
+	rr := httptest.NewRecorder()
+	Handler{&env, Status}.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("draining status returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+}
+
 func TestProxy(t *testing.T) {
 	backendResponse := "I am the backend"
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -270,3 +283,114 @@ func TestProxy(t *testing.T) {
 	}
 
 }
+
+func TestProxyStripsDSC(t *testing.T) {
+	var got *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	u1, _ := uuid.NewUUID()
+	req, err := http.NewRequest("GET", "/foo?a=1&dscv="+u1.String()+"&b=2&hma%63=x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	req.AddCookie(&http.Cookie{Name: "hmac", Value: CreateMAC(&u1, []byte("123"))})
+	req.Header.Set("X-DSC-Status", "valid")
+
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proxy: httputil.NewSingleHostReverseProxy(backendURL)}
+	handler := http.Handler(Handler{&env, ProxyHandler})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if got.URL.RawQuery != "a=1&b=2" {
+		t.Errorf("dscv was forwarded: %s", got.URL.RawQuery)
+	}
+	if got.Header.Get("Cookie") != "session=abc" {
+		t.Errorf("hmac cookie was forwarded: %s", got.Header.Get("Cookie"))
+	}
+	if got.Header.Get("X-DSC-Status") != "" {
+		t.Errorf("client X-DSC-* header was forwarded")
+	}
+}
+
+func TestProxyUpstreamHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	rules, err := ParseHeaderRules("set X-DSC-Client: {{.Client}}; set X-DSC-Mode: {{.Mode}}; " +
+		"add X-Upstream: http://a:b; remove X-Secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u1, _ := uuid.NewUUID()
+	hmac := url.QueryEscape(CreateMAC(&u1, []byte("123")))
+	req, _ := http.NewRequest("GET", "/foo?dscv="+u1.String()+"&hmac="+hmac, nil)
+	req.RemoteAddr = "10.0.0.3:4321"
+	req.Header.Set("X-Secret", "s3cr3t")
+
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both", UpstreamHeaders: rules, KeepDSCParams: true,
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL)}
+	req.Header.Set("X-DSC-Client", "spoofed")
+	handler := http.Handler(Handler{&env, ProxyHandler})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	want := map[string]string{"X-Dsc-Client": "10.0.0.3", "X-Dsc-Mode": "url", "X-Upstream": "http://a:b", "X-Secret": ""}
+	for name, value := range want {
+		if got.Get(name) != value {
+			t.Errorf("upstream header %s: got %q want %q", name, got.Get(name), value)
+		}
+	}
+
+	if _, err := ParseHeaderRules("replace X-Foo: bar"); err == nil {
+		t.Error("an unknown header rule was accepted")
+	}
+}
+
+func TestProxyUpstreamScope(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	rules, err := ParseHeaderRules("set X-DSC-Scope: {{.Scope}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both", UpstreamHeaders: rules,
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL)}
+
+	u1, _ := uuid.NewUUID()
+	req, _ := http.NewRequest("GET", "http://app.example.com:8443/foo?dscv="+u1.String(), nil)
+	req.AddCookie(&http.Cookie{Name: "hmac", Value: CreateMAC(&u1, []byte("123"))})
+	rr := httptest.NewRecorder()
+	Handler{&env, ProxyHandler}.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || got.Get("X-DSC-Scope") != "app.example.com" {
+		t.Errorf("cookie mode scope: got %v %q", rr.Code, got.Get("X-DSC-Scope"))
+	}
+
+	hmac := url.QueryEscape(CreateMAC(&u1, []byte("123")))
+	req, _ = http.NewRequest("GET", "http://app.example.com:8443/foo?dscv="+u1.String()+"&hmac="+hmac, nil)
+	rr = httptest.NewRecorder()
+	Handler{&env, ProxyHandler}.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || got.Get("X-DSC-Scope") != "" {
+		t.Errorf("url mode scope: got %v %q", rr.Code, got.Get("X-DSC-Scope"))
+	}
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedHeaders are the proxy headers a client could forge.
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host",
+	"X-Forwarded-Port", "X-Real-IP"}
+
+// SetForwarded describes the client facing side of r, as received by DSC, in its X-Forwarded-Proto, -Host and
+// -Port headers and appends an RFC 7239 element to its Forwarded header. Values already set by a trusted proxy in
+// front of DSC are kept, those sent by anybody else are overwritten. httputil.ReverseProxy appends the client
+// address to X-Forwarded-For.
+func SetForwarded(r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	port := "80"
+	if proto == "https" {
+		port = "443"
+	}
+	if _, p, err := net.SplitHostPort(r.Host); err == nil {
+		port = p
+	}
+	for name, value := range map[string]string{"X-Forwarded-Proto": proto, "X-Forwarded-Host": r.Host,
+		"X-Forwarded-Port": port} {
+		if r.Header.Get(name) == "" || !Proxied(r) {
+			r.Header.Set(name, value)
+		}
+	}
+
+	element := []string{"for=" + forwardedNode(r.RemoteAddr), "host=" + forwardedValue(r.Host), "proto=" + proto}
+	if prior := r.Header.Get("Forwarded"); prior != "" {
+		r.Header.Set("Forwarded", prior+", "+strings.Join(element, ";"))
+	} else {
+		r.Header.Set("Forwarded", strings.Join(element, ";"))
+	}
+}
+
+// forwardedNode formats a remote address as an RFC 7239 node, quoting IPv6 addresses.
+func forwardedNode(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if strings.Contains(host, ":") {
+		return `"[` + host + `]"`
+	}
+	if host == "" {
+		return "unknown"
+	}
+	return host
+}
+
+// forwardedValue quotes v when it isn't a plain RFC 7230 token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+		}
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestSetForwarded(t *testing.T) {
+	cases := []struct {
+		name string
+		tls  bool
+		want map[string]string
+	}{
+		{"plain", false, map[string]string{
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "dsc.example.com:8000",
+			"X-Forwarded-Port":  "8000",
+			"Forwarded":         `for=evil, for="[2001:db8::1]";host="dsc.example.com:8000";proto=http`,
+			"X-Real-IP":         "10.0.0.1",
+		}},
+		{"kept from load balancer", true, map[string]string{
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "lb.example.com",
+		}},
+		{"forged by client", false, map[string]string{
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "dsc.example.com:8000",
+		}},
+	}
+	trusted, _ := ParseNetworks([]string{"2001:db8::/32"})
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://dsc.example.com:8000/", nil)
+		req.RemoteAddr = "[2001:db8::1]:4711"
+		req.Header.Set("Forwarded", "for=evil")
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+		if c.name != "plain" {
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "lb.example.com")
+		}
+		if c.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if c.name == "kept from load balancer" {
+			TrustedProxies(trusted, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req = r
+			})).ServeHTTP(nil, req)
+		}
+		SetForwarded(req)
+		for name, value := range c.want {
+			if got := req.Header.Get(name); got != value {
+				t.Errorf("%s %s: got %q want %q", c.name, name, got, value)
+			}
+		}
+	}
+}
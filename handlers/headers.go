@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// HeaderRule sets, adds, defaults or removes a header on paths under Prefix, or on every path when Prefix is
+// empty. Values are text/templates.
+type HeaderRule struct {
+	Prefix string
+	Op     string
+	Name   string
+	Value  *template.Template
+}
+
+// ParseHeaderRules parses a list of "[/prefix ]op Name[: value]" rules separated by "|", ";" or newlines, where
+// op is one of set, add, default (set unless already present) or remove. Only the first colon separates the name
+// from the value, so values may hold colons, and a semicolon only separates rules when a rule follows it, so
+// values may hold semicolons too. Separators within {{...}} are left to the template.
+func ParseHeaderRules(spec string) ([]HeaderRule, error) {
+	var rules []HeaderRule
+	for _, raw := range splitHeaderRules(spec) {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		var rule HeaderRule
+		fields := strings.SplitN(raw, " ", 2)
+		if strings.HasPrefix(fields[0], "/") && len(fields) == 2 {
+			rule.Prefix = fields[0]
+			fields = strings.SplitN(strings.TrimSpace(fields[1]), " ", 2)
+		}
+		if len(fields) != 2 {
+			return nil, errors.Errorf("bad header rule %q", raw)
+		}
+		rule.Op = strings.ToLower(fields[0])
+		switch rule.Op {
+		case "remove":
+			rule.Name = strings.TrimSpace(fields[1])
+		case "set", "add", "default":
+			kv := strings.SplitN(fields[1], ":", 2)
+			if len(kv) != 2 {
+				return nil, errors.Errorf("bad header rule %q, want %s Name: value", raw, rule.Op)
+			}
+			rule.Name = strings.TrimSpace(kv[0])
+			tmpl, err := template.New(rule.Name).Option("missingkey=error").Parse(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad header rule %q", raw)
+			}
+			rule.Value = tmpl
+		default:
+			return nil, errors.Errorf("bad header rule %q, want set, add, default or remove", raw)
+		}
+		if rule.Name == "" {
+			return nil, errors.Errorf("bad header rule %q, missing header name", raw)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitHeaderRules splits spec on the rule separators found outside {{...}} actions.
+func splitHeaderRules(spec string) []string {
+	var raws []string
+	depth, start := 0, 0
+	for i := 0; i < len(spec); i++ {
+		switch {
+		case strings.HasPrefix(spec[i:], "{{"):
+			depth++
+			i++
+		case strings.HasPrefix(spec[i:], "}}") && depth > 0:
+			depth--
+			i++
+		case depth > 0:
+		case spec[i] == '|' || spec[i] == '\n' || spec[i] == ';' && startsHeaderRule(spec[i+1:]):
+			raws = append(raws, spec[start:i])
+			start = i + 1
+		}
+	}
+	return append(raws, spec[start:])
+}
+
+// startsHeaderRule tells whether s begins with a "[/prefix ]op " rule.
+func startsHeaderRule(s string) bool {
+	fields := strings.Fields(s)
+	if len(fields) > 1 && strings.HasPrefix(fields[0], "/") {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return false
+	}
+	switch strings.ToLower(fields[0]) {
+	case "set", "add", "default", "remove":
+		return true
+	}
+	return false
+}
+
+// applyHeaderRules applies the rules matching path to h in order, rendering values with data.
+func applyHeaderRules(rules []HeaderRule, h http.Header, path string, data interface{}) error {
+	for _, rule := range rules {
+		if !hasPathPrefix(path, rule.Prefix) {
+			continue
+		}
+		if rule.Op == "remove" {
+			h.Del(rule.Name)
+			continue
+		}
+		if rule.Op == "default" && h.Get(rule.Name) != "" {
+			continue
+		}
+		var value bytes.Buffer
+		if err := rule.Value.Execute(&value, data); err != nil {
+			return errors.Wrapf(err, "rendering %s header", rule.Name)
+		}
+		if rule.Op == "add" {
+			h.Add(rule.Name, value.String())
+		} else {
+			h.Set(rule.Name, value.String())
+		}
+	}
+	return nil
+}
+
+// ResponseInfo is the data handed to response header templates.
+type ResponseInfo struct {
+	Path   string
+	Host   string
+	Client string
+}
+
+// ResponseHeaders returns a middleware applying rules to every response, upstream or DSC's own, right before
+// its headers are written.
+func ResponseHeaders(rules []HeaderRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hw := &headerWriter{ResponseWriter: w, rules: rules,
+				info: ResponseInfo{Path: r.URL.Path, Host: r.Host, Client: ClientIP(r)}}
+			next.ServeHTTP(hw, r)
+			hw.apply()
+		})
+	}
+}
+
+type headerWriter struct {
+	http.ResponseWriter
+	rules   []HeaderRule
+	info    ResponseInfo
+	applied bool
+}
+
+func (hw *headerWriter) apply() {
+	if hw.applied {
+		return
+	}
+	hw.applied = true
+	// Rules are validated on startup, a rendering error only drops the header.
+	_ = applyHeaderRules(hw.rules, hw.Header(), hw.info.Path, hw.info)
+}
+
+func (hw *headerWriter) WriteHeader(code int) {
+	hw.apply()
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	hw.apply()
+	return hw.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses through.
+func (hw *headerWriter) Flush() {
+	hw.apply()
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets upgraded connections through.
+func (hw *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := hw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	return h.Hijack()
+}
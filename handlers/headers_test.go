@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	rules, err := ParseHeaderRules(`remove Server | remove X-Powered-By
+		set Strict-Transport-Security: max-age=31536000; includeSubDomains
+		default X-Content-Type-Options: nosniff
+		/api set Content-Security-Policy: default-src 'none'
+		default Content-Security-Policy: default-src 'self'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.1")
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("X-Content-Type-Options", "upstream")
+		_, _ = w.Write([]byte("hello"))
+	})
+	handler := ResponseHeaders(rules)(upstream)
+
+	cases := []struct {
+		path string
+		want map[string]string
+	}{
+		{"/api/users", map[string]string{
+			"Server":                    "",
+			"X-Powered-By":              "",
+			"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+			"X-Content-Type-Options":    "upstream",
+			"Content-Security-Policy":   "default-src 'none'",
+		}},
+		{"/index.html", map[string]string{
+			"Content-Security-Policy": "default-src 'self'",
+		}},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.path, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		for name, value := range c.want {
+			if got := rr.Header().Get(name); got != value {
+				t.Errorf("%s %s: got %q want %q", c.path, name, got, value)
+			}
+		}
+	}
+}
+
+func TestParseHeaderRulesSeparators(t *testing.T) {
+	rules, err := ParseHeaderRules("set X-A: {{.Client | printf \"%s;x\"}}; set X-B: a; b | /foo remove X-C\n" +
+		"default X-D: c; Set X-E: d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ prefix, op, name string }{
+		{"", "set", "X-A"}, {"", "set", "X-B"}, {"/foo", "remove", "X-C"}, {"", "default", "X-D"}, {"", "set", "X-E"},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules want %d: %+v", len(rules), len(want), rules)
+	}
+	for i, w := range want {
+		if r := rules[i]; r.Prefix != w.prefix || r.Op != w.op || r.Name != w.name {
+			t.Errorf("rule %d: got %s %s %s want %s %s %s", i, r.Prefix, r.Op, r.Name, w.prefix, w.op, w.name)
+		}
+	}
+
+	h := http.Header{}
+	if err := applyHeaderRules(rules, h, "/", ResponseInfo{Client: "10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("X-A") != "10.0.0.1;x" || h.Get("X-B") != "a; b" {
+		t.Errorf("unexpected values: %v", h)
+	}
+}
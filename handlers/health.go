@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck is a dependency readiness depends on, Check returns nil while it's usable.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of a HealthCheck, as reported by the health document.
+type CheckResult struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Duration  string    `json:"duration"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// OK tells whether the check passed.
+func (c CheckResult) OK() bool {
+	return c.Status == "ok"
+}
+
+// HealthChecks runs the readiness checks, each bounded by a timeout, and caches their results for a while so
+// probes don't hammer the dependencies.
+type HealthChecks struct {
+	timeout time.Duration
+	ttl     time.Duration
+	checks  []HealthCheck
+
+	mu      sync.Mutex
+	results map[string]CheckResult
+}
+
+// NewHealthChecks returns HealthChecks running checks for up to timeout each, and reusing their results for ttl.
+func NewHealthChecks(timeout, ttl time.Duration, checks ...HealthCheck) *HealthChecks {
+	return &HealthChecks{timeout: timeout, ttl: ttl, checks: checks, results: make(map[string]CheckResult)}
+}
+
+// Results returns the result of every check, running the ones whose cached result expired concurrently, and
+// whether all of them passed. A nil HealthChecks has no checks.
+func (h *HealthChecks) Results() (map[string]CheckResult, bool) {
+	results := make(map[string]CheckResult)
+	if h == nil {
+		return results, true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, check := range h.checks {
+		if cached, ok := h.results[check.Name]; ok && now.Sub(cached.CheckedAt) < h.ttl {
+			results[check.Name] = cached
+			continue
+		}
+		wg.Add(1)
+		go func(check HealthCheck) {
+			defer wg.Done()
+			result := h.run(check)
+			mu.Lock()
+			results[check.Name] = result
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+	ok := true
+	for name, result := range results {
+		h.results[name] = result
+		ok = ok && result.OK()
+	}
+	return results, ok
+}
+
+// run runs check, giving up on it after the timeout even if it doesn't honor its context.
+func (h *HealthChecks) run(check HealthCheck) CheckResult {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- check.Check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.Errorf("timed out after %s", h.timeout)
+	}
+	result := CheckResult{Status: "ok", Duration: time.Since(started).String(), CheckedAt: started}
+	if err != nil {
+		result.Status = "failing"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Live is the liveness probe, it answers as long as the process serves requests.
+func Live(env *Env, w http.ResponseWriter, r *http.Request) error {
+	_, err := w.Write([]byte("OK\n"))
+	return err
+}
+
+// Ready is the readiness probe, it fails once shutdown starts or while any health check fails. It's served on
+// the public listener, so the failing checks are only named in the health document.
+func Ready(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if env.Readiness.Draining() {
+		return StatusError{503, errors.New("shutting down")}
+	}
+	if _, ok := env.Health.Results(); !ok {
+		return StatusError{503, errors.New("not ready")}
+	}
+	_, err := w.Write([]byte("OK\n"))
+	return err
+}
+
+// HealthDocument is the json representation of the instance health.
+type HealthDocument struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Health is an admin http handler writing the health document, its status code follows Ready's.
+func Health(env *Env, w http.ResponseWriter, r *http.Request) error {
+	if err := checkAdmin(env, r); err != nil {
+		return err
+	}
+	return AdminHealth(env, w, r)
+}
+
+// AdminHealth is Health without the token check, for the admin listener which authenticates requests on its own.
+func AdminHealth(env *Env, w http.ResponseWriter, r *http.Request) error {
+	results, ok := env.Health.Results()
+	doc := HealthDocument{Status: "ok", Checks: results}
+	code := http.StatusOK
+	switch {
+	case env.Readiness.Draining():
+		doc.Status, code = "draining", http.StatusServiceUnavailable
+	case !ok:
+		doc.Status, code = "failing", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(doc)
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecksCache(t *testing.T) {
+	var calls int32
+	health := NewHealthChecks(time.Second, time.Hour, HealthCheck{Name: "counted", Check: func(context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}})
+	for i := 0; i < 3; i++ {
+		if _, ok := health.Results(); !ok {
+			t.Fatal("passing check reported as failing")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("cached check ran %d times, want 1", calls)
+	}
+}
+
+func TestHealthChecksTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	health := NewHealthChecks(50*time.Millisecond, 0, HealthCheck{Name: "stuck", Check: func(context.Context) error {
+		<-block
+		return nil
+	}})
+	started := time.Now()
+	results, ok := health.Results()
+	if ok || results["stuck"].OK() {
+		t.Fatal("stuck check reported as passing")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("stuck check held the probe for %s", elapsed)
+	}
+	if !strings.Contains(results["stuck"].Error, "timed out") {
+		t.Errorf("stuck check error: got %q", results["stuck"].Error)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	env := Env{Log: logrus.New(), Readiness: &Readiness{}, Health: NewHealthChecks(time.Second, 0,
+		HealthCheck{Name: "redis", Check: func(context.Context) error { return errors.New("connection refused") }},
+		HealthCheck{Name: "upstream", Check: func(context.Context) error { return nil }})}
+
+	for _, tc := range []struct {
+		h    func(*Env, http.ResponseWriter, *http.Request) error
+		code int
+		body string
+	}{
+		{Live, http.StatusOK, "OK"},
+		{Ready, http.StatusServiceUnavailable, "not ready"},
+		{AdminHealth, http.StatusServiceUnavailable, `"status":"failing"`},
+	} {
+		rr := httptest.NewRecorder()
+		Handler{&env, tc.h}.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != tc.code || !strings.Contains(rr.Body.String(), tc.body) {
+			t.Errorf("got %v %q, want %v with %q", rr.Code, rr.Body.String(), tc.code, tc.body)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	Handler{&env, AdminHealth}.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	var doc HealthDocument
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Checks["redis"].Error != "connection refused" || !doc.Checks["upstream"].OK() {
+		t.Errorf("unexpected health document: %+v", doc)
+	}
+
+	rr = httptest.NewRecorder()
+	Handler{&env, Health}.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("health document without a token got status code %v", rr.Code)
+	}
+}
+
+func TestReadyDraining(t *testing.T) {
+	env := Env{Log: logrus.New(), Readiness: &Readiness{}}
+	rr := httptest.NewRecorder()
+	Handler{&env, Ready}.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("ready without checks got status code %v", rr.Code)
+	}
+	env.Readiness.Drain()
+	for _, h := range []func(*Env, http.ResponseWriter, *http.Request) error{Ready, AdminHealth} {
+		rr = httptest.NewRecorder()
+		Handler{&env, h}.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("draining probe got status code %v", rr.Code)
+		}
+	}
+	if !strings.Contains(rr.Body.String(), `"status":"draining"`) {
+		t.Errorf("draining health document: got %q", rr.Body.String())
+	}
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"context"
+	"crypto/x509"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+)
+
+// ClientIdentity is the verified client certificate of a request.
+type ClientIdentity struct {
+	Subject string
+	CN      string
+	// SANs holds the DNS, URI, email and IP subject alternative names.
+	SANs []SAN
+}
+
+// SAN is a subject alternative name, Type is the label it gets in the identity header: DNS, URI, Email or IP.
+type SAN struct {
+	Type  string
+	Value string
+}
+
+// String formats the identity the way Envoy's X-Forwarded-Client-Cert header does.
+func (id *ClientIdentity) String() string {
+	parts := []string{"Subject=" + quoteXFCC(id.Subject)}
+	for _, san := range id.SANs {
+		value := san.Value
+		if strings.ContainsAny(value, `,;="\`) {
+			value = quoteXFCC(value)
+		}
+		parts = append(parts, san.Type+"="+value)
+	}
+	return strings.Join(parts, ";")
+}
+
+// quoteXFCC quotes v, escaping backslashes and quotes, so that names can't add elements or fields to the header.
+func quoteXFCC(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+func newClientIdentity(cert *x509.Certificate) *ClientIdentity {
+	id := &ClientIdentity{Subject: cert.Subject.String(), CN: cert.Subject.CommonName}
+	for _, name := range cert.DNSNames {
+		id.SANs = append(id.SANs, SAN{"DNS", name})
+	}
+	for _, u := range cert.URIs {
+		id.SANs = append(id.SANs, SAN{"URI", u.String()})
+	}
+	for _, email := range cert.EmailAddresses {
+		id.SANs = append(id.SANs, SAN{"Email", email})
+	}
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, SAN{"IP", ip.String()})
+	}
+	return id
+}
+
+type identityKey struct{}
+
+// Identity returns the verified client certificate identity of r, or nil.
+func Identity(r *http.Request) *ClientIdentity {
+	id, _ := r.Context().Value(identityKey{}).(*ClientIdentity)
+	return id
+}
+
+// IdentityRule allows or lets skip the dscv check the clients whose certificate Field matches Pattern, on paths
+// under Prefix, or on every path when Prefix is empty.
+type IdentityRule struct {
+	Prefix  string
+	Action  string
+	Field   string
+	Pattern string
+}
+
+// ParseIdentityRules parses a list of "[/prefix ]action field=pattern" rules separated by "|" or newlines, where
+// action is allow or skip-dscv and field one of subject, cn or san. Patterns may start or end with a "*"
+// wildcard.
+func ParseIdentityRules(spec string) ([]IdentityRule, error) {
+	var rules []IdentityRule
+	for _, raw := range strings.FieldsFunc(spec, func(r rune) bool { return r == '|' || r == '\n' }) {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 {
+			continue
+		}
+		var rule IdentityRule
+		if strings.HasPrefix(fields[0], "/") {
+			rule.Prefix, fields = fields[0], fields[1:]
+		}
+		if len(fields) != 2 {
+			return nil, errors.Errorf("bad identity rule %q", strings.TrimSpace(raw))
+		}
+		rule.Action = strings.ToLower(fields[0])
+		if rule.Action != "allow" && rule.Action != "skip-dscv" {
+			return nil, errors.Errorf("bad identity rule %q, want allow or skip-dscv", strings.TrimSpace(raw))
+		}
+		kv := strings.SplitN(fields[1], "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.Errorf("bad identity rule %q, want field=pattern", strings.TrimSpace(raw))
+		}
+		rule.Field, rule.Pattern = strings.ToLower(kv[0]), kv[1]
+		if rule.Field != "subject" && rule.Field != "cn" && rule.Field != "san" {
+			return nil, errors.Errorf("bad identity rule %q, want subject, cn or san", strings.TrimSpace(raw))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func matchPattern(pattern, value string) bool {
+	switch {
+	case pattern == "*":
+		return value != ""
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(value, strings.TrimPrefix(pattern, "*"))
+	}
+	return pattern == value
+}
+
+// Matches tells whether id satisfies the rule.
+func (rule IdentityRule) Matches(id *ClientIdentity) bool {
+	if id == nil {
+		return false
+	}
+	switch rule.Field {
+	case "subject":
+		return matchPattern(rule.Pattern, id.Subject)
+	case "cn":
+		return matchPattern(rule.Pattern, id.CN)
+	}
+	for _, san := range id.SANs {
+		if matchPattern(rule.Pattern, san.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipsDSCV tells whether r comes from a client trusted to skip the dscv check.
+func skipsDSCV(rules []IdentityRule, r *http.Request) bool {
+	id := Identity(r)
+	for _, rule := range rules {
+		if rule.Action == "skip-dscv" && hasPathPrefix(r.URL.Path, rule.Prefix) && rule.Matches(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCertificates returns a middleware recording the verified client certificate identity of requests. Paths
+// covered by allow rules are refused with a 403 to clients matching none of them. Unless header is empty, the
+// identity replaces any client supplied header of that name, to be forwarded upstream.
+func ClientCertificates(rules []IdentityRule, header string, log *logrus.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var id *ClientIdentity
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				id = newClientIdentity(r.TLS.VerifiedChains[0][0])
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+			}
+			restricted, allowed := false, false
+			for _, rule := range rules {
+				if rule.Action == "allow" && hasPathPrefix(r.URL.Path, rule.Prefix) {
+					restricted = true
+					allowed = allowed || rule.Matches(id)
+				}
+			}
+			if restricted && !allowed {
+				fields := logrus.Fields{"granted": "false", "path": r.URL.Path}
+				if id != nil {
+					fields["identity"] = id.String()
+				}
+				requestLog(log, r).WithFields(fields).Warn("Client certificate not allowed.")
+				http.Error(w, withRequestID("client certificate not allowed", r), http.StatusForbidden)
+				return
+			}
+			if header != "" {
+				r.Header.Del(header)
+				if id != nil {
+					r.Header.Set(header, id.String())
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
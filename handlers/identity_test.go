@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/Sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func withClientCert(r *http.Request, cn, uri string) *http.Request {
+	u, _ := url.Parse(uri)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn, Organization: []string{"example"}},
+		URIs: []*url.URL{u}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestIdentityRules(t *testing.T) {
+	rules, err := ParseIdentityRules(`/_dsc/judge allow san=spiffe://mesh/sa/envoy
+		skip-dscv san=spiffe://internal/*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forwarded http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	env := &Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), IdentityRules: rules,
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL)}
+	router := http.NewServeMux()
+	router.Handle("/_dsc/judge/", Handler{env, JudgeW})
+	router.Handle("/", Handler{env, ProxyHandler})
+	handler := ClientCertificates(rules, "X-Forwarded-Client-Cert", logrus.New())(router)
+
+	cases := []struct {
+		name string
+		path string
+		cn   string
+		uri  string
+		want int
+	}{
+		{"envoy judge", "/_dsc/judge/foo", "envoy", "spiffe://mesh/sa/envoy", http.StatusInternalServerError},
+		{"internal judge", "/_dsc/judge/foo", "billing", "spiffe://internal/sa/billing", http.StatusForbidden},
+		{"anonymous judge", "/_dsc/judge/foo", "", "", http.StatusForbidden},
+		{"internal proxy", "/foo", "billing", "spiffe://internal/sa/billing", http.StatusOK},
+		{"anonymous proxy", "/foo", "", "", http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		forwarded = nil
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Header.Set("X-Forwarded-Client-Cert", "Subject=\"CN=forged\"")
+		if c.cn != "" {
+			req = withClientCert(req, c.cn, c.uri)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s: got status code %v want %v", c.name, rr.Code, c.want)
+		}
+		if forwarded != nil {
+			want := `Subject="CN=billing,O=example";URI=spiffe://internal/sa/billing`
+			if got := forwarded.Get("X-Forwarded-Client-Cert"); got != want {
+				t.Errorf("%s: forwarded identity %q want %q", c.name, got, want)
+			}
+		}
+	}
+}
+
+func TestClientIdentityString(t *testing.T) {
+	u, _ := url.Parse("spiffe://mesh/sa/billing")
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, DNSNames: []string{"billing.local"},
+		URIs: []*url.URL{u}, EmailAddresses: []string{"ops@example.com"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}
+	want := `Subject="CN=billing";DNS=billing.local;URI=spiffe://mesh/sa/billing;Email=ops@example.com;IP=10.0.0.1`
+	if got := newClientIdentity(cert).String(); got != want {
+		t.Errorf("identity: got %q want %q", got, want)
+	}
+}
+
+func TestClientIdentityQuotesSANs(t *testing.T) {
+	u, _ := url.Parse("spiffe://mesh/sa/billing;URI=spiffe://mesh/sa/admin")
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, URIs: []*url.URL{u},
+		EmailAddresses: []string{`"ops,By=x"@example.com`}}
+	want := `Subject="CN=billing";URI="spiffe://mesh/sa/billing;URI=spiffe://mesh/sa/admin";` +
+		`Email="\"ops,By=x\"@example.com"`
+	if got := newClientIdentity(cert).String(); got != want {
+		t.Errorf("identity: got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RequestLimits bound the size and duration of requests.
+type RequestLimits struct {
+	// MaxBodyBytes is answered with a 413 when exceeded, zero means no limit.
+	MaxBodyBytes int64
+	// MaxHeaderBytes is answered with a 431 when exceeded, zero means the server wide limit.
+	MaxHeaderBytes int
+	// Timeout cancels the request, upstream exchange included, zero means no limit. Upgrade requests are exempt.
+	Timeout time.Duration
+}
+
+// tooLarge tells whether err comes from a body read past the limit set by http.MaxBytesReader, which has no
+// dedicated error type.
+func tooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// headerBytes approximates the size of r's request line and headers as read from the wire.
+func headerBytes(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for name, values := range r.Header {
+		for _, v := range values {
+			n += len(name) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// Limits returns a middleware enforcing the RequestLimits of the longest matching prefix in routes.
+func Limits(routes *Routes) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limits, ok := routes.Match(r.URL.Path).(*RequestLimits)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if limits.MaxHeaderBytes > 0 && headerBytes(r) > limits.MaxHeaderBytes {
+				http.Error(w, "request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			if limits.MaxBodyBytes > 0 {
+				if r.ContentLength > limits.MaxBodyBytes {
+					http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				if r.Body != nil {
+					r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+				}
+			}
+			// Upgraded streams are bounded by the websocket settings instead.
+			if limits.Timeout > 0 && !isUpgrade(r) {
+				ctx, cancel := context.WithTimeout(r.Context(), limits.Timeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	routes := &Routes{}
+	routes.Add("/", &RequestLimits{MaxBodyBytes: 8, MaxHeaderBytes: 1024})
+	routes.Add("/upload", &RequestLimits{MaxBodyBytes: 64, MaxHeaderBytes: 1024})
+	routes.Add("/slow", &RequestLimits{Timeout: 10 * time.Millisecond})
+
+	handler := Limits(routes)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			http.Error(w, r.Context().Err().Error(), http.StatusGatewayTimeout)
+		}
+	}))
+
+	cases := []struct {
+		name   string
+		path   string
+		body   string
+		header string
+		want   int
+	}{
+		{"small body", "/", "tiny", "", http.StatusOK},
+		{"large body", "/", "a body too large", "", http.StatusRequestEntityTooLarge},
+		{"route override", "/upload/file", "a body too large", "", http.StatusOK},
+		{"large headers", "/", "", strings.Repeat("a", 2048), http.StatusRequestHeaderFieldsTooLarge},
+		{"route timeout", "/slow", "", "", http.StatusGatewayTimeout},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", c.path, strings.NewReader(c.body))
+		if c.name == "large body" {
+			// Exercise the streamed check along with the Content-Length one.
+			req.ContentLength = -1
+		}
+		if c.header != "" {
+			req.Header.Set("X-Padding", c.header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s: got status code %v want %v", c.name, rr.Code, c.want)
+		}
+	}
+}
+
+func TestLimitsSkipTimeoutOnUpgrades(t *testing.T) {
+	routes := &Routes{}
+	routes.Add("/", &RequestLimits{Timeout: time.Millisecond})
+	var deadline bool
+	handler := Limits(routes)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, deadline = r.Context().Deadline()
+	}))
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if deadline {
+		t.Error("the route timeout applies to an upgrade request")
+	}
+}
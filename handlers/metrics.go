@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestMetrics counts the requests served by the public listener.
+type RequestMetrics struct {
+	started  time.Time
+	inFlight int64
+
+	mu    sync.Mutex
+	codes map[int]uint64
+}
+
+// NewRequestMetrics returns empty RequestMetrics.
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{started: time.Now(), codes: make(map[int]uint64)}
+}
+
+// Count returns a middleware counting requests by status code.
+func (m *RequestMetrics) Count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&m.inFlight, 1)
+		cw := &codeWriter{ResponseWriter: w}
+		defer func() {
+			atomic.AddInt64(&m.inFlight, -1)
+			if cw.code == 0 {
+				cw.code = http.StatusOK
+			}
+			m.mu.Lock()
+			m.codes[cw.code]++
+			m.mu.Unlock()
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// codeWriter records the status code of a response, letting streamed and upgraded responses through.
+type codeWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (cw *codeWriter) WriteHeader(code int) {
+	if cw.code == 0 {
+		cw.code = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *codeWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *codeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	if cw.code == 0 {
+		cw.code = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Metrics is an http handler exposing the request counters, breaker state and active bans in the prometheus
+// text format.
+func Metrics(env *Env, w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if m := env.Metrics; m != nil {
+		m.mu.Lock()
+		codes := make([]int, 0, len(m.codes))
+		for code := range m.codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		fmt.Fprintln(w, "# TYPE dsc_requests_total counter")
+		for _, code := range codes {
+			fmt.Fprintf(w, "dsc_requests_total{code=\"%d\"} %d\n", code, m.codes[code])
+		}
+		m.mu.Unlock()
+		fmt.Fprintln(w, "# TYPE dsc_requests_in_flight gauge")
+		fmt.Fprintf(w, "dsc_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+		fmt.Fprintln(w, "# TYPE dsc_uptime_seconds gauge")
+		fmt.Fprintf(w, "dsc_uptime_seconds %d\n", int64(time.Since(m.started)/time.Second))
+	}
+	if env.Breaker != nil {
+		state := env.Breaker.State()
+		fmt.Fprintln(w, "# TYPE dsc_upstream_breaker_state gauge")
+		for _, s := range []string{"closed", "open", "half-open"} {
+			v := 0
+			if s == state {
+				v = 1
+			}
+			fmt.Fprintf(w, "dsc_upstream_breaker_state{state=%q} %d\n", s, v)
+		}
+	}
+	if env.Bans != nil {
+		bans, err := env.Bans.List()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "# TYPE dsc_bans_active gauge")
+		_, err = fmt.Fprintf(w, "dsc_bans_active %d\n", len(bans))
+		return err
+	}
+	return nil
+}
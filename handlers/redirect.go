@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// RedirectHTTPS returns a handler redirecting requests to their https url with a 308, which keeps the method
+// and body. Requests for the exempt paths, such as health probes, are served by next instead. Hosts outside
+// domains are redirected to the first one, unless domains is empty. A port other than 443 is added to the url.
+func RedirectHTTPS(port string, domains, exempt []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range exempt {
+			if r.URL.Path == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if len(domains) > 0 && !containsFold(domains, host) {
+			host = domains[0]
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// HSTS returns a middleware setting the Strict-Transport-Security header of responses served over TLS to value,
+// replacing the upstream's. Browsers ignore it on plain http.
+func HSTS(value string) func(http.Handler) http.Handler {
+	rules := []HeaderRule{{Op: "set", Name: "Strict-Transport-Security",
+		Value: template.Must(template.New("hsts").Parse(value))}}
+	return func(next http.Handler) http.Handler {
+		tls := ResponseHeaders(rules)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				tls.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
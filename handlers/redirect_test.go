@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHTTPS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK\n"))
+	})
+	cases := []struct {
+		port, target, host string
+		want               int
+		location           string
+	}{
+		{"443", "/foo?a=1", "dsc.example.com:8080", http.StatusPermanentRedirect, "https://dsc.example.com/foo?a=1"},
+		{"8443", "/foo", "dsc.example.com", http.StatusPermanentRedirect, "https://dsc.example.com:8443/foo"},
+		{"443", "/foo", "evil.example.net", http.StatusPermanentRedirect, "https://dsc.example.com/foo"},
+		{"443", "/_dsc/status", "dsc.example.com", http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		handler := RedirectHTTPS(c.port, []string{"dsc.example.com", "api.example.com"}, []string{"/_dsc/status"}, next)
+		req := httptest.NewRequest("POST", c.target, nil)
+		req.Host = c.host
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.want || rr.Header().Get("Location") != c.location {
+			t.Errorf("%s%s: got %v %q want %v %q", c.host, c.target, rr.Code, rr.Header().Get("Location"),
+				c.want, c.location)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	handler := HSTS("max-age=31536000")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=60")
+	}))
+	for _, secure := range []bool{true, false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		want := "max-age=60"
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+			want = "max-age=31536000"
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Strict-Transport-Security"); got != want {
+			t.Errorf("tls %v: got %q want %q", secure, got, want)
+		}
+	}
+}
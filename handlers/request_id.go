@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// maxRequestIDLength bounds the incoming request IDs accepted.
+const maxRequestIDLength = 128
+
+// RequestIDs returns a middleware tagging every request with an ID, taken from header when the request comes
+// straight from one of the trusted networks, or generated otherwise. The ID is set on the request, so it's
+// forwarded upstream, and on the response.
+func RequestIDs(header string, trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !validRequestID(id) || !fromNetworks(r, trusted) {
+				id = uuid.New().String()
+			}
+			r.Header.Set(header, id)
+			w.Header().Set(header, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		})
+	}
+}
+
+// RequestID returns the ID of r, if any.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// fromNetworks tells whether r's peer address lies in one of networks.
+func fromNetworks(r *http.Request, networks []*net.IPNet) bool {
+	return inNetworks(net.ParseIP(remoteHost(r)), networks)
+}
+
+// inNetworks tells whether ip lies in one of networks.
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of r's peer address.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ParseNetworks parses a coma separated list of CIDRs or bare addresses.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// requestLog returns log with r's ID attached.
+func requestLog(log *logrus.Logger, r *http.Request) *logrus.Entry {
+	entry := logrus.NewEntry(log)
+	if id := RequestID(r); id != "" {
+		entry = entry.WithField("request_id", id)
+	}
+	return entry
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDs(t *testing.T) {
+	trusted, err := ParseNetworks([]string{"10.0.0.0/8", " 192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged bytes.Buffer
+	log := logrus.New()
+	log.Out = &logged
+	env := &Env{Log: log}
+	var forwarded string
+	handler := RequestIDs("X-Request-ID", trusted)(Handler{Env: env, H: func(e *Env, w http.ResponseWriter,
+		r *http.Request) error {
+		forwarded = r.Header.Get("X-Request-ID")
+		return errorForbidden
+	}})
+
+	cases := []struct {
+		remote, incoming string
+		kept             bool
+	}{
+		{"10.1.2.3:4711", "ticket-42", true},
+		{"192.0.2.1:4711", "ticket-42", true},
+		{"198.51.100.7:4711", "ticket-42", false},
+		{"10.1.2.3:4711", "bad id", false},
+	}
+	for _, c := range cases {
+		logged.Reset()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("X-Request-ID", c.incoming)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		id := rr.Header().Get("X-Request-ID")
+		if (id == c.incoming) != c.kept || id == "" {
+			t.Errorf("%s %q: got id %q", c.remote, c.incoming, id)
+		}
+		if forwarded != id {
+			t.Errorf("%s: forwarded id %q, answered %q", c.remote, forwarded, id)
+		}
+		if !strings.Contains(rr.Body.String(), "request id: "+id) {
+			t.Errorf("%s: error body %q misses the request id", c.remote, rr.Body.String())
+		}
+		if !strings.Contains(logged.String(), "request_id="+id) {
+			t.Errorf("%s: log %q misses the request id", c.remote, logged.String())
+		}
+	}
+}
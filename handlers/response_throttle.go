@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/throttled/throttled"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxFormKeyBytes caps how much of a request body is read to find a form field used as throttle key.
+const maxFormKeyBytes = 64 << 10
+
+// ResponseThrottle charges a client's quota only when the upstream answers with one of Statuses, so that, for
+// instance, failed logins can be limited without penalizing successful ones. Requests are checked, but not
+// charged, before they are forwarded.
+type ResponseThrottle struct {
+	RateLimiter throttled.RateLimiter
+	Routes      *Routes
+	Statuses    map[int]bool
+	// KeyBy is "client", the address resolved by TrustedProxies, or "header:<name>", "query:<name>" or
+	// "form:<name>" to key by a request field.
+	KeyBy  string
+	Denied *DeniedResponse
+}
+
+// NewResponseThrottle validates keyBy and returns a ResponseThrottle for the given prefixes and statuses.
+func NewResponseThrottle(limiter throttled.RateLimiter, prefixes []string, statuses []int, keyBy string,
+	denied *DeniedResponse) (*ResponseThrottle, error) {
+	if keyBy != "client" {
+		kv := strings.SplitN(keyBy, ":", 2)
+		if len(kv) != 2 || kv[1] == "" || (kv[0] != "header" && kv[0] != "query" && kv[0] != "form") {
+			return nil, errors.Errorf("bad response throttle key %q", keyBy)
+		}
+	}
+	t := &ResponseThrottle{
+		RateLimiter: limiter,
+		Routes:      &Routes{},
+		Statuses:    make(map[int]bool),
+		KeyBy:       keyBy,
+		Denied:      denied,
+	}
+	for _, p := range prefixes {
+		t.Routes.Add(p, p)
+	}
+	for _, s := range statuses {
+		t.Statuses[s] = true
+	}
+	return t, nil
+}
+
+func (t *ResponseThrottle) key(r *http.Request) (string, error) {
+	if t.KeyBy == "client" {
+		return ClientIP(r), nil
+	}
+	kv := strings.SplitN(t.KeyBy, ":", 2)
+	switch kv[0] {
+	case "header":
+		return r.Header.Get(kv[1]), nil
+	case "query":
+		return r.URL.Query().Get(kv[1]), nil
+	}
+
+	// Read the form from a copy of the body, so that the upstream still gets it.
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFormKeyBytes+1))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if tooLarge(err) {
+		return "", StatusError{413, err}
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxFormKeyBytes {
+		return "", StatusError{413, errors.New("form too large")}
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", StatusError{400, err}
+	}
+	return form.Get(kv[1]), nil
+}
+
+// Check refuses r when its key is over quota, writing the denied response. Otherwise it returns a func to be
+// called with the upstream status, or nil when r isn't on a throttled route.
+func (t *ResponseThrottle) Check(env *Env, w http.ResponseWriter, r *http.Request) (func(status int), bool, error) {
+	if t == nil {
+		return nil, true, nil
+	}
+	prefix, ok := t.Routes.Match(r.URL.Path).(string)
+	if !ok {
+		return nil, true, nil
+	}
+	field, err := t.key(r)
+	if err != nil {
+		return nil, false, err
+	}
+	key := "dsc:resp:" + prefix + "\n" + strings.ToLower(field)
+
+	// Peek without charging: the key is locked once no request is left in its quota.
+	limited, result, err := t.RateLimiter.RateLimit(key, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	if limited || result.Remaining <= 0 {
+		info := rateLimitInfo(result)
+		if info.RetryAfter < 0 {
+			info.RetryAfter = info.Reset
+		}
+		setRateLimitHeaders(w, info)
+		requestLog(env.Log, r).WithFields(logrus.Fields{"granted": "false", "client": ClientIP(r), "path": prefix}).Warn(
+			"Response throttle exhausted.")
+		return nil, false, t.Denied.Write(w, info)
+	}
+
+	return func(status int) {
+		if !t.Statuses[status] {
+			return
+		}
+		if _, _, err := t.RateLimiter.RateLimit(key, 1); err != nil {
+			requestLog(env.Log, r).Error(err)
+		}
+	}, true, nil
+}
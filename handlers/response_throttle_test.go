@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResponseThrottle(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("password") != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: 1})
+	denied, _ := NewDeniedResponse("text", "", "")
+	responses, err := NewResponseThrottle(limiter, []string{"/login"}, []int{401}, "form:user", denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both", Responses: responses,
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL)}
+	handler := http.Handler(Handler{&env, ProxyHandler})
+
+	login := func(password string) int {
+		u1, _ := uuid.NewUUID()
+		hmac := url.QueryEscape(CreateMAC(&u1, []byte("123")))
+		body := strings.NewReader(url.Values{"user": {"alice"}, "password": {password}}.Encode())
+		req, _ := http.NewRequest("POST", "/login?dscv="+u1.String()+"&hmac="+hmac, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Successful logins are never charged.
+	for i := 0; i < 5; i++ {
+		if status := login("good"); status != http.StatusOK {
+			t.Fatalf("good login got status code: got %v want %v", status, http.StatusOK)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if status := login("bad"); status != http.StatusUnauthorized {
+			t.Fatalf("bad login got status code: got %v want %v", status, http.StatusUnauthorized)
+		}
+	}
+	if status := login("good"); status != http.StatusTooManyRequests {
+		t.Errorf("locked out login got status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestResponseThrottleIgnoresForgedForwardedFor(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: 1})
+	denied, _ := NewDeniedResponse("text", "", "")
+	responses, err := NewResponseThrottle(limiter, []string{"/login"}, []int{401}, "client", denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both", Responses: responses,
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL)}
+	handler := TrustedProxies(nil, false)(Handler{&env, ProxyHandler})
+
+	var status int
+	for i := 0; i < 3; i++ {
+		u1, _ := uuid.NewUUID()
+		hmac := url.QueryEscape(CreateMAC(&u1, []byte("123")))
+		req := httptest.NewRequest("POST", "/login?dscv="+u1.String()+"&hmac="+hmac, nil)
+		req.RemoteAddr = "198.51.100.7:4711"
+		// A new forged address on every attempt.
+		req.Header.Set("X-Forwarded-For", "192.0.2."+strconv.Itoa(i+1))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		status = rr.Code
+	}
+	if status != http.StatusTooManyRequests {
+		t.Errorf("rotating X-Forwarded-For got status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestResponseThrottleFormTooLarge(t *testing.T) {
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerHour(1), MaxBurst: 1})
+	denied, _ := NewDeniedResponse("text", "", "")
+	responses, err := NewResponseThrottle(limiter, []string{"/login"}, []int{401}, "form:user", denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("user=alice&password=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Body = http.MaxBytesReader(httptest.NewRecorder(), req.Body, 8)
+	_, err = responses.key(req)
+	if se, ok := err.(StatusError); !ok || se.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized form got error: got %v want a %v", err, http.StatusRequestEntityTooLarge)
+	}
+}
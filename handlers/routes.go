@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// Routes maps path prefixes to per-route settings, the longest matching prefix wins. Prefixes match on path
+// segment boundaries, so "/api" covers "/api/v1" but not "/apiary".
+type Routes struct {
+	prefixes []string
+	values   map[string]interface{}
+}
+
+// ParseRouteSpec parses a coma separated list of "prefix=value" pairs, as used by the per-route settings.
+func ParseRouteSpec(spec string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], "/") {
+			return nil, errors.Errorf("bad route setting %q, want /prefix=value", pair)
+		}
+		routes[kv[0]] = kv[1]
+	}
+	return routes, nil
+}
+
+// Add sets the value served for prefix.
+func (rt *Routes) Add(prefix string, value interface{}) {
+	if rt.values == nil {
+		rt.values = make(map[string]interface{})
+	}
+	if _, ok := rt.values[prefix]; !ok {
+		rt.prefixes = append(rt.prefixes, prefix)
+		sort.Slice(rt.prefixes, func(i, j int) bool { return len(rt.prefixes[i]) > len(rt.prefixes[j]) })
+	}
+	rt.values[prefix] = value
+}
+
+// Match returns the value of the longest prefix of path, or nil.
+func (rt *Routes) Match(path string) interface{} {
+	if rt == nil {
+		return nil
+	}
+	for _, p := range rt.prefixes {
+		if hasPathPrefix(path, p) {
+			return rt.values[p]
+		}
+	}
+	return nil
+}
+
+// hasPathPrefix tells whether path is prefix or lies below it.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
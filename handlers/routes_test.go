@@ -0,0 +1,24 @@
+package handlers
+
+import "testing"
+
+func TestRoutesMatchSegments(t *testing.T) {
+	routes := &Routes{}
+	routes.Add("/", "root")
+	routes.Add("/api", "api")
+	routes.Add("/static/", "static")
+	cases := map[string]string{
+		"/api":        "api",
+		"/api/v1":     "api",
+		"/apiary":     "root",
+		"/static/a":   "static",
+		"/static":     "root",
+		"/staticfoo":  "root",
+		"/other/path": "root",
+	}
+	for path, want := range cases {
+		if got := routes.Match(path); got != want {
+			t.Errorf("%s: got %v want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// dscParams are the query string values DSC reads on proxied requests.
+var dscParams = map[string]bool{"dscv": true, "hmac": true}
+
+// stripDSC removes DSC's own query string values, hmac cookie and X-DSC-* headers from a request about to be
+// forwarded upstream, so that tokens don't end up in upstream logs nor clash with the app's own parameters.
+func stripDSC(r *http.Request) {
+	if r.URL.RawQuery != "" {
+		var kept []string
+		for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+			// Query() decodes names, so encoded ones such as dsc%76 must be stripped as well.
+			name := strings.SplitN(pair, "=", 2)[0]
+			if decoded, err := url.QueryUnescape(name); err == nil {
+				name = decoded
+			}
+			if !dscParams[name] {
+				kept = append(kept, pair)
+			}
+		}
+		r.URL.RawQuery = strings.Join(kept, "&")
+	}
+
+	if cookies := r.Header["Cookie"]; len(cookies) > 0 {
+		var kept []string
+		for _, line := range cookies {
+			for _, c := range strings.Split(line, ";") {
+				if c = strings.TrimSpace(c); c != "" && !strings.HasPrefix(c, "hmac=") {
+					kept = append(kept, c)
+				}
+			}
+		}
+		r.Header.Del("Cookie")
+		if len(kept) > 0 {
+			r.Header.Set("Cookie", strings.Join(kept, "; "))
+		}
+	}
+
+	for name := range r.Header {
+		if strings.HasPrefix(name, textproto.CanonicalMIMEHeaderKey("X-DSC-")) {
+			r.Header.Del(name)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// tarpitForget is how long a key has to stay away before its tarpit delay starts over.
+const tarpitForget = 10 * time.Minute
+
+// Tarpit holds over quota requests for a delay that doubles on every consecutive offence, at most MaxHeld at a
+// time, before they are rejected, or served when Serve is set.
+type Tarpit struct {
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Serve    bool
+	held     chan struct{}
+	mu       sync.Mutex
+	hits     map[string]tarpitHits
+}
+
+type tarpitHits struct {
+	count int
+	last  time.Time
+}
+
+// NewTarpit returns a Tarpit holding at most maxHeld requests.
+func NewTarpit(delay, maxDelay time.Duration, maxHeld int, serve bool) *Tarpit {
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	return &Tarpit{
+		Delay:    delay,
+		MaxDelay: maxDelay,
+		Serve:    serve,
+		held:     make(chan struct{}, maxHeld),
+		hits:     make(map[string]tarpitHits),
+	}
+}
+
+// delay returns the hold time for the next offence of key.
+func (t *Tarpit) delay(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	h := t.hits[key]
+	if now.Sub(h.last) > tarpitForget {
+		h.count = 0
+	}
+	d := t.Delay
+	for i := 0; i < h.count && d < t.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > t.MaxDelay {
+		d = t.MaxDelay
+	}
+	t.hits[key] = tarpitHits{count: h.count + 1, last: now}
+
+	if len(t.hits) > 65536 {
+		for k, v := range t.hits {
+			if now.Sub(v.last) > tarpitForget {
+				delete(t.hits, k)
+			}
+		}
+	}
+	return d
+}
+
+// Hold blocks for the key's delay. It returns false right away when the tarpit is full, and when the client goes
+// away while held.
+func (t *Tarpit) Hold(key string, done <-chan struct{}) bool {
+	select {
+	case t.held <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-t.held }()
+
+	timer := time.NewTimer(t.delay(key))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
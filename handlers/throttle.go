@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/throttled/throttled"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// RateLimitInfo describes the state of a client's quota, it's the data handed to denied response templates.
+type RateLimitInfo struct {
+	Limit      int `json:"limit"`
+	Remaining  int `json:"remaining"`
+	Reset      int `json:"reset"`
+	RetryAfter int `json:"retry_after"`
+}
+
+// DeniedResponse renders the 429 response sent to throttled clients.
+type DeniedResponse struct {
+	ContentType string
+	Template    *template.Template
+}
+
+type deniedJSON struct {
+	Error string `json:"error"`
+	RateLimitInfo
+}
+
+// NewDeniedResponse builds a DeniedResponse for format, which is one of "text", "json" or "template"; the
+// latter renders the text/template in templateFile with a RateLimitInfo.
+func NewDeniedResponse(format, templateFile, contentType string) (*DeniedResponse, error) {
+	switch format {
+	case "", "text":
+		return &DeniedResponse{
+			ContentType: "text/plain; charset=utf-8",
+			Template:    template.Must(template.New("denied").Parse("limit exceeded\n")),
+		}, nil
+	case "json":
+		return &DeniedResponse{ContentType: "application/json"}, nil
+	case "template":
+		raw, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading throttle denied template")
+		}
+		tmpl, err := template.New("denied").Parse(string(raw))
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing throttle denied template")
+		}
+		if contentType == "" {
+			contentType = "text/html; charset=utf-8"
+		}
+		return &DeniedResponse{ContentType: contentType, Template: tmpl}, nil
+	}
+	return nil, errors.Errorf("unknown throttle denied format %q", format)
+}
+
+// Write sends the 429 response for info.
+func (d *DeniedResponse) Write(w http.ResponseWriter, info RateLimitInfo) error {
+	var body bytes.Buffer
+	if d.Template == nil {
+		if err := json.NewEncoder(&body).Encode(deniedJSON{Error: "limit exceeded", RateLimitInfo: info}); err != nil {
+			return err
+		}
+	} else if err := d.Template.Execute(&body, info); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", d.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// Throttle limits requests like throttled.HTTPRateLimiter does, but also writes the IETF RateLimit-* headers,
+// charges requests by their Costs and answers denied requests with a configurable DeniedResponse.
+type Throttle struct {
+	RateLimiter throttled.RateLimiter
+	VaryBy      interface {
+		Key(*http.Request) string
+	}
+	Costs  *Costs
+	Denied *DeniedResponse
+	// Tarpit, when set, holds denied requests before answering them.
+	Tarpit *Tarpit
+	Log    *logrus.Logger
+}
+
+// RateLimit wraps an http.Handler to limit incoming requests.
+func (t *Throttle) RateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var k string
+		if t.VaryBy != nil {
+			k = t.VaryBy.Key(r)
+		}
+
+		limited, result, err := t.RateLimiter.RateLimit(k, t.Costs.Cost(r))
+		if err != nil {
+			requestLog(t.Log, r).Error(err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		info := rateLimitInfo(result)
+		if limited && info.RetryAfter < 0 {
+			info.RetryAfter = info.Reset
+		}
+		setRateLimitHeaders(w, info)
+		if !limited {
+			t.serve(h, k, w, r)
+			return
+		}
+		if t.Tarpit != nil {
+			held := t.Tarpit.Hold(k, r.Context().Done())
+			if r.Context().Err() != nil {
+				return
+			}
+			if held && t.Tarpit.Serve {
+				requestLog(t.Log, r).WithFields(logrus.Fields{"client": ClientIP(r)}).Warn("Serving tarpitted request.")
+				w.Header().Del("Retry-After")
+				t.serve(h, k, w, r)
+				return
+			}
+		}
+		requestLog(t.Log, r).WithFields(logrus.Fields{"granted": "false", "client": ClientIP(r)}).Warn("Throttled request.")
+		if err := t.Denied.Write(w, info); err != nil {
+			requestLog(t.Log, r).Error(err)
+		}
+	})
+}
+
+// serve passes r on to h, charging its body afterwards when its length wasn't known upfront.
+func (t *Throttle) serve(h http.Handler, k string, w http.ResponseWriter, r *http.Request) {
+	if !t.Costs.unmetered(r) {
+		h.ServeHTTP(w, r)
+		return
+	}
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	h.ServeHTTP(w, r)
+	t.chargeBody(k, r, atomic.LoadInt64(&body.n))
+}
+
+// chargeBody charges n bytes of body already read to k. The request went through, so a cost higher than what's
+// left of the quota spends the rest of it rather than nothing.
+func (t *Throttle) chargeBody(k string, r *http.Request, n int64) {
+	cost := t.Costs.Body(n)
+	if cost == 0 {
+		return
+	}
+	limited, result, err := t.RateLimiter.RateLimit(k, cost)
+	if err == nil && limited && result.Remaining > 0 {
+		_, _, err = t.RateLimiter.RateLimit(k, result.Remaining)
+	}
+	if err != nil {
+		requestLog(t.Log, r).Error(err)
+	}
+}
+
+func rateLimitInfo(result throttled.RateLimitResult) RateLimitInfo {
+	return RateLimitInfo{
+		Limit:      result.Limit,
+		Remaining:  result.Remaining,
+		Reset:      ceilSeconds(result.ResetAfter),
+		RetryAfter: ceilSeconds(result.RetryAfter),
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d < 0 {
+		return -1
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// setRateLimitHeaders writes both the legacy X-RateLimit-* headers and their IETF RateLimit-* counterparts,
+// negative values are omitted.
+func setRateLimitHeaders(w http.ResponseWriter, info RateLimitInfo) {
+	set := func(names []string, v int) {
+		if v < 0 {
+			return
+		}
+		for _, name := range names {
+			w.Header().Set(name, strconv.Itoa(v))
+		}
+	}
+	set([]string{"X-RateLimit-Limit", "RateLimit-Limit"}, info.Limit)
+	set([]string{"X-RateLimit-Remaining", "RateLimit-Remaining"}, info.Remaining)
+	set([]string{"X-RateLimit-Reset", "RateLimit-Reset"}, info.Reset)
+	set([]string{"Retry-After"}, info.RetryAfter)
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottleDeniedJSON(t *testing.T) {
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	denied, err := NewDeniedResponse("json", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{MaxTime: 60, DSCKey: "123"}
+	th := Throttle{RateLimiter: limiter, Denied: denied, Log: logrus.New()}
+	handler := th.RateLimit(Handler{&env, Status})
+
+	req, _ := http.NewRequest("GET", "/_dsc/status", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if rr.Header().Get("RateLimit-Limit") != "1" || rr.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Errorf("missing rate limit headers: %v", rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" || rr.Header().Get("RateLimit-Reset") == "" {
+		t.Errorf("missing Retry-After or RateLimit-Reset headers: %v", rr.Header())
+	}
+	var got deniedJSON
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RetryAfter < 1 || got.Remaining != 0 {
+		t.Errorf("unexpected denied body: %s", rr.Body.String())
+	}
+}
+
+func TestCosts(t *testing.T) {
+	costs, err := ParseCosts("POST /upload=10,/upload=3,/search=2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		method, path string
+		length       int64
+		want         int
+	}{
+		{"POST", "/upload/file", 0, 10},
+		{"GET", "/upload/file", 0, 3},
+		{"GET", "/search", 0, 2},
+		{"GET", "/other", 0, 1},
+		{"PUT", "/other", 3 << 20, 4},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.path, nil)
+		req.ContentLength = c.length
+		if got := costs.Cost(req); got != c.want {
+			t.Errorf("%s %s: got cost %d want %d", c.method, c.path, got, c.want)
+		}
+	}
+	if _, err := ParseCosts("upload=1", 0); err == nil {
+		t.Error("a cost without a path prefix was accepted")
+	}
+}
+
+func TestThrottleCost(t *testing.T) {
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 9})
+	denied, _ := NewDeniedResponse("text", "", "")
+	costs, _ := ParseCosts("POST /=6", 0)
+	env := Env{MaxTime: 60, DSCKey: "123"}
+	th := Throttle{RateLimiter: limiter, Costs: costs, Denied: denied, Log: logrus.New()}
+	handler := th.RateLimit(Handler{&env, Status})
+
+	want := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, w := range want {
+		req, _ := http.NewRequest("POST", "/", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != w {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, w)
+		}
+	}
+}
+
+func TestThrottleTarpit(t *testing.T) {
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	denied, _ := NewDeniedResponse("text", "", "")
+	env := Env{MaxTime: 60, DSCKey: "123"}
+	tarpit := NewTarpit(20*time.Millisecond, 40*time.Millisecond, 1, false)
+	th := Throttle{RateLimiter: limiter, Denied: denied, Tarpit: tarpit, Log: logrus.New()}
+	handler := th.RateLimit(Handler{&env, Status})
+
+	req, _ := http.NewRequest("GET", "/_dsc/status", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var took []time.Duration
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rr, req)
+		took = append(took, time.Since(start))
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+		}
+	}
+	if took[0] < 20*time.Millisecond || took[1] < 40*time.Millisecond || took[2] > time.Second {
+		t.Errorf("unexpected tarpit delays: %v", took)
+	}
+
+	// A full tarpit rejects right away.
+	tarpit.held <- struct{}{}
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if time.Since(start) >= 20*time.Millisecond {
+		t.Error("full tarpit held a request")
+	}
+}
+
+func TestThrottleChunkedBodyCost(t *testing.T) {
+	store, _ := memstore.New(0)
+	limiter, _ := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 9})
+	denied, _ := NewDeniedResponse("text", "", "")
+	costs, _ := ParseCosts("", 1)
+	th := Throttle{RateLimiter: limiter, Costs: costs, Denied: denied, Log: logrus.New()}
+	handler := th.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+	}))
+
+	want := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, w := range want {
+		req, _ := http.NewRequest("POST", "/", bytes.NewReader(make([]byte, 16<<20)))
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != w {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, w)
+		}
+	}
+}
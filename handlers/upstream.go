@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned by the upstream transport while the breaker refuses requests.
+var ErrBreakerOpen = errors.New("upstream circuit breaker is open")
+
+// Breaker trips after Failures consecutive upstream failures and refuses requests for Cooldown, then lets a
+// single trial request through: its success closes the breaker, its failure opens it again.
+type Breaker struct {
+	Failures int
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// NewBreaker returns a closed Breaker.
+func NewBreaker(failures int, cooldown time.Duration) *Breaker {
+	return &Breaker{Failures: failures, Cooldown: cooldown}
+}
+
+// State returns "closed", "open" or "half-open".
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state(time.Now())
+}
+
+func (b *Breaker) state(now time.Time) string {
+	switch {
+	case b.failures < b.Failures:
+		return "closed"
+	case now.Sub(b.openedAt) < b.Cooldown:
+		return "open"
+	}
+	return "half-open"
+}
+
+// RetryAfter returns how long until the breaker lets a trial request through.
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state(time.Now()) != "open" {
+		return 0
+	}
+	return b.Cooldown - time.Since(b.openedAt)
+}
+
+// Allow tells whether a request may be sent upstream.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state(time.Now()) {
+	case "closed":
+		return true
+	case "half-open":
+		if !b.trial {
+			b.trial = true
+			return true
+		}
+	}
+	return false
+}
+
+// Record accounts for the outcome of a request allowed through.
+func (b *Breaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.Failures {
+		b.openedAt = time.Now()
+	}
+}
+
+// Release gives back a request allowed through whose outcome says nothing about the upstream, such as one the
+// client canceled.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+// RetryBudget caps retries to a ratio of the requests seen, so that retries can't pile up on a struggling
+// upstream. Every request deposits Ratio tokens, up to a reserve of 10, and every retry spends one.
+type RetryBudget struct {
+	Ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+const retryReserve = 10
+
+// NewRetryBudget returns a RetryBudget with a full reserve.
+func NewRetryBudget(ratio float64) *RetryBudget {
+	return &RetryBudget{Ratio: ratio, tokens: retryReserve}
+}
+
+func (rb *RetryBudget) deposit() {
+	rb.mu.Lock()
+	rb.tokens += rb.Ratio
+	if rb.tokens > retryReserve {
+		rb.tokens = retryReserve
+	}
+	rb.mu.Unlock()
+}
+
+func (rb *RetryBudget) withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.tokens < 1 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// UpstreamTransport adds per-route timeouts, retries and a circuit breaker to the transport used to reach the
+// upstream. Any of Timeouts, Budget and Breaker may be nil.
+type UpstreamTransport struct {
+	Transport http.RoundTripper
+	// Timeouts maps upstream path prefixes to the time.Duration allowed to each attempt, response body included.
+	Timeouts *Routes
+	// Retries is the number of times failed idempotent requests without a body are retried.
+	Retries int
+	// Backoff is the delay before the first retry, doubled on every further one.
+	Backoff time.Duration
+	Budget  *RetryBudget
+	Breaker *Breaker
+	Log     *logrus.Logger
+}
+
+// failed tells whether an upstream answer to r counts as a failure. Requests canceled by the client don't.
+func failed(r *http.Request, res *http.Response, err error) bool {
+	if err != nil {
+		return !canceled(r, err)
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// canceled tells whether an attempt ended because the client went away or r's own deadline passed.
+func canceled(r *http.Request, err error) bool {
+	return err != nil && (r.Context().Err() != nil || errors.Cause(err) == context.Canceled)
+}
+
+func retryable(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+	default:
+		return false
+	}
+	return (r.Body == nil || r.Body == http.NoBody) && !isUpgrade(r)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *UpstreamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.Budget != nil {
+		t.Budget.deposit()
+	}
+	backoff := t.Backoff
+	for attempt := 0; ; attempt++ {
+		if t.Breaker != nil && !t.Breaker.Allow() {
+			return nil, ErrBreakerOpen
+		}
+		res, err := t.attempt(r)
+		if canceled(r, err) {
+			if t.Breaker != nil {
+				t.Breaker.Release()
+			}
+			return res, err
+		}
+		bad := failed(r, res, err)
+		if t.Breaker != nil {
+			t.Breaker.Record(bad)
+		}
+		if !bad || attempt >= t.Retries || !retryable(r) || r.Context().Err() != nil {
+			return res, err
+		}
+		if t.Budget != nil && !t.Budget.withdraw() {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		if t.Log != nil {
+			requestLog(t.Log, r).WithFields(logrus.Fields{"path": r.URL.Path, "attempt": attempt + 1}).Warn("Retrying upstream request.")
+		}
+		// Full jitter keeps retries from synchronizing.
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (t *UpstreamTransport) attempt(r *http.Request) (*http.Response, error) {
+	timeout, ok := t.Timeouts.Match(r.URL.Path).(time.Duration)
+	// Upgraded streams are bounded by the websocket settings instead.
+	if !ok || timeout <= 0 || isUpgrade(r) {
+		return t.Transport.RoundTrip(r)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	res, err := t.Transport.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			err = context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelBody releases an attempt's context once its response has been read.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+// Fallback is the response served while the upstream breaker is open.
+type Fallback struct {
+	Status      int
+	ContentType string
+	Body        string
+}
+
+// ProxyError returns the httputil.ReverseProxy ErrorHandler: oversized bodies get a 413, timeouts a 504, an
+// open breaker the fallback response and anything else a 502.
+func ProxyError(fallback Fallback, breaker *Breaker, log *logrus.Logger) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		switch {
+		case errors.Cause(err) == ErrBreakerOpen:
+			if breaker != nil {
+				secs := int(breaker.RetryAfter()/time.Second) + 1
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", secs))
+			}
+			w.Header().Set("Content-Type", fallback.ContentType)
+			w.WriteHeader(fallback.Status)
+			_, _ = io.WriteString(w, fallback.Body)
+			return
+		// http.MaxBytesReader gives no typed error before go 1.19.
+		case strings.Contains(err.Error(), "request body too large"):
+			http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		requestLog(log, r).WithFields(logrus.Fields{"path": r.URL.Path}).Error(err)
+		if errors.Cause(err) == context.DeadlineExceeded {
+			http.Error(w, "upstream timeout", http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
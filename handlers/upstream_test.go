@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newFlakyProxy(t *testing.T, upstream *UpstreamTransport, h http.HandlerFunc) (*httputil.ReverseProxy, func()) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	u, _ := url.Parse(srv.URL)
+	upstream.Transport = http.DefaultTransport
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = upstream
+	proxy.ErrorHandler = ProxyError(Fallback{Status: 503, ContentType: "text/plain", Body: "fallback"},
+		upstream.Breaker, logrus.New())
+	return proxy, srv.Close
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	var calls int32
+	upstream := &UpstreamTransport{Retries: 2, Backoff: time.Millisecond, Budget: NewRetryBudget(0.2)}
+	proxy, closeUpstream := newFlakyProxy(t, upstream, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer closeUpstream()
+
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK || calls != 3 {
+		t.Errorf("GET got status code %v after %d calls, want 200 after 3", rr.Code, calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader("body")))
+	if rr.Code != http.StatusServiceUnavailable || calls != 1 {
+		t.Errorf("POST got status code %v after %d calls, want 503 after 1", rr.Code, calls)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	timeouts := &Routes{}
+	timeouts.Add("/slow", 10*time.Millisecond)
+	upstream := &UpstreamTransport{Timeouts: timeouts}
+	proxy, closeUpstream := newFlakyProxy(t, upstream, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+	defer closeUpstream()
+
+	for path, want := range map[string]int{"/slow": http.StatusGatewayTimeout, "/fast": http.StatusOK} {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != want {
+			t.Errorf("%s got status code %v want %v", path, rr.Code, want)
+		}
+	}
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	var calls int32
+	breaker := NewBreaker(2, 50*time.Millisecond)
+	proxy, closeUpstream := newFlakyProxy(t, &UpstreamTransport{Breaker: breaker},
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) <= 2 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		})
+	defer closeUpstream()
+
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		proxy.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		return rr
+	}
+	get()
+	get()
+	if state := breaker.State(); state != "open" {
+		t.Fatalf("breaker is %s after two failures, want open", state)
+	}
+	rr := get()
+	body, _ := ioutil.ReadAll(rr.Body)
+	if rr.Code != http.StatusServiceUnavailable || string(body) != "fallback" || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("open breaker served %v %q, want the fallback", rr.Code, body)
+	}
+	if calls != 2 {
+		t.Errorf("open breaker let a request through, %d upstream calls", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if rr := get(); rr.Code != http.StatusOK {
+		t.Errorf("trial request got status code %v want 200", rr.Code)
+	}
+	if state := breaker.State(); state != "closed" {
+		t.Errorf("breaker is %s after a successful trial, want closed", state)
+	}
+}
+
+func TestUpstreamClientCancel(t *testing.T) {
+	var calls int32
+	breaker := NewBreaker(1, time.Minute)
+	budget := NewRetryBudget(0)
+	upstream := &UpstreamTransport{Retries: 2, Backoff: time.Millisecond, Budget: budget, Breaker: breaker}
+	proxy, closeUpstream := newFlakyProxy(t, upstream, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(200 * time.Millisecond)
+	})
+	defer closeUpstream()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if state := breaker.State(); state != "closed" {
+		t.Errorf("breaker is %s after a client cancel, want closed", state)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 || budget.tokens != retryReserve {
+		t.Errorf("canceled request was retried: %d calls, %v budget tokens", n, budget.tokens)
+	}
+	if failed(httptest.NewRequest("GET", "/", nil), nil, context.Canceled) {
+		t.Error("context.Canceled counted as an upstream failure")
+	}
+}
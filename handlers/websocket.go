@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isUpgrade reports whether r asks to switch protocols, as websocket handshakes do.
+func isUpgrade(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return r.Header.Get("Upgrade") != ""
+		}
+	}
+	return false
+}
+
+// Hijack hands the client connection over to the reverse proxy once the upstream accepted an upgrade, bounding
+// it with the websocket idle timeout and maximum lifetime.
+func (s *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	conn = s.upgrades.track(conn)
+	if s.idle <= 0 && s.lifetime <= 0 {
+		return conn, brw, nil
+	}
+	dc := &deadlineConn{Conn: conn, idle: s.idle}
+	if s.lifetime > 0 {
+		dc.end = time.Now().Add(s.lifetime)
+	}
+	dc.extend()
+	// Buffered data was read before the deadline was in place, it's handed back untouched.
+	return dc, bufio.NewReadWriter(brw.Reader, bufio.NewWriter(dc)), nil
+}
+
+// deadlineConn pushes its deadline idle forward on every read and write, never past end.
+type deadlineConn struct {
+	net.Conn
+	idle time.Duration
+	end  time.Time
+	mu   sync.Mutex
+}
+
+func (c *deadlineConn) extend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := c.end
+	if c.idle > 0 {
+		next := time.Now().Add(c.idle)
+		if deadline.IsZero() || next.Before(deadline) {
+			deadline = next
+		}
+	}
+	_ = c.Conn.SetDeadline(deadline)
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+// Upgrades tracks the upgraded connections being proxied, which http.Server.Shutdown leaves alone, so that they
+// can be drained too.
+type Upgrades struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+// NewUpgrades returns an empty Upgrades.
+func NewUpgrades() *Upgrades {
+	return &Upgrades{conns: make(map[*trackedConn]struct{})}
+}
+
+func (u *Upgrades) track(conn net.Conn) net.Conn {
+	if u == nil {
+		return conn
+	}
+	tc := &trackedConn{Conn: conn, upgrades: u}
+	u.mu.Lock()
+	u.conns[tc] = struct{}{}
+	u.mu.Unlock()
+	return tc
+}
+
+// Len returns the number of open upgraded connections.
+func (u *Upgrades) Len() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.conns)
+}
+
+// Drain waits for the upgraded connections to be closed until ctx is done, then closes the remaining ones and
+// returns how many were.
+func (u *Upgrades) Drain(ctx context.Context) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for u.Len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			u.mu.Lock()
+			remaining := make([]*trackedConn, 0, len(u.conns))
+			for conn := range u.conns {
+				remaining = append(remaining, conn)
+			}
+			u.mu.Unlock()
+			for _, conn := range remaining {
+				conn.Close()
+			}
+			return len(remaining)
+		}
+	}
+	return 0
+}
+
+type trackedConn struct {
+	net.Conn
+	upgrades *Upgrades
+	once     sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.upgrades.mu.Lock()
+		delete(c.upgrades.conns, c)
+		c.upgrades.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
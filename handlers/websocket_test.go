@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEchoUpgradeBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+}
+
+func dialUpgrade(t *testing.T, front string) (net.Conn, *bufio.Reader) {
+	u1, _ := uuid.NewUUID()
+	hmac := url.QueryEscape(CreateMAC(&u1, []byte("123")))
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("GET /chat?dscv=" + u1.String() + "&hmac=" + hmac + " HTTP/1.1\r\nHost: dsc\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake got status code: got %v want %v", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+	return conn, br
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both",
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL), WebSocketIdleTimeout: 100 * time.Millisecond}
+	front := httptest.NewServer(Handler{&env, ProxyHandler})
+	defer front.Close()
+
+	conn, br := dialUpgrade(t, front.URL)
+	defer conn.Close()
+	_, _ = conn.Write([]byte("ping\n"))
+	line, err := br.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("echo through the upgraded connection failed: %q, %v", line, err)
+	}
+
+	// Idle connections get closed.
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("idle upgraded connection was kept open")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("idle upgraded connection was not closed by DSC")
+	}
+}
+
+func TestWebSocketRejectsBadToken(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both",
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL)}
+	req, _ := http.NewRequest("GET", "/chat?dscv=bogus", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rr := httptest.NewRecorder()
+	Handler{&env, ProxyHandler}.ServeHTTP(rr, req)
+	if rr.Code == http.StatusSwitchingProtocols || rr.Code == http.StatusOK {
+		t.Errorf("upgrade with a bad dscv got status code %v", rr.Code)
+	}
+}
+
+func TestWebSocketDrain(t *testing.T) {
+	backend := newEchoUpgradeBackend(t)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	upgrades := NewUpgrades()
+	env := Env{MaxTime: 60, DSCKey: "123", Log: logrus.New(), Proto: "both",
+		Proxy: httputil.NewSingleHostReverseProxy(backendURL), Upgrades: upgrades}
+	front := httptest.NewServer(Handler{&env, ProxyHandler})
+	defer front.Close()
+
+	conn, br := dialUpgrade(t, front.URL)
+	defer conn.Close()
+	if n := upgrades.Len(); n != 1 {
+		t.Fatalf("tracked upgrades: got %v want 1", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if closed := upgrades.Drain(ctx); closed != 1 {
+		t.Errorf("drain closed %v connections, want 1", closed)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Error("drained upgraded connection was kept open")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("drained upgraded connection was not closed by DSC")
+	}
+	if n := upgrades.Len(); n != 0 {
+		t.Errorf("tracked upgrades after drain: got %v want 0", n)
+	}
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	gorilla_handlers "github.com/gorilla/handlers"
 	"github.com/spf13/viper"
-	"github.com/tylerb/graceful"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jfardello/dsc-go/application"
@@ -21,19 +25,119 @@ func newConfig() (*viper.Viper, error) {
 	c.SetDefault("max_time", 3600)
 	c.SetDefault("http_addr", ":8888")
 	c.SetDefault("upstream", "http://localhost:8080")
+	c.SetDefault("upstream_ca_file", "")
+	c.SetDefault("upstream_cert_file", "")
+	c.SetDefault("upstream_key_file", "")
+	c.SetDefault("upstream_server_name", "")
+	c.SetDefault("upstream_insecure_skip_verify", false)
+	c.SetDefault("upstream_dial_timeout", "30s")
+	c.SetDefault("upstream_keepalive", "30s")
+	c.SetDefault("upstream_tls_handshake_timeout", "10s")
+	c.SetDefault("upstream_response_header_timeout", "0s")
+	c.SetDefault("upstream_idle_conn_timeout", "90s")
+	c.SetDefault("upstream_max_idle_conns", 100)
+	c.SetDefault("upstream_max_idle_conns_per_host", 16)
+	c.SetDefault("upstream_max_conns_per_host", 0)
 	c.SetDefault("http_cert_file", "")
 	c.SetDefault("http_key_file", "")
+	c.SetDefault("http_cert_reload_interval", "30s")
+	c.SetDefault("domains", "")
+	c.SetDefault("tls_min_version", "1.2")
+	c.SetDefault("tls_max_version", "")
+	c.SetDefault("tls_cipher_suites", "")
+	c.SetDefault("tls_curves", "")
+	c.SetDefault("tls_alpn", "h2,http/1.1")
+	c.SetDefault("tls_ocsp_staple_file", "")
+	c.SetDefault("http_redirect_addr", "")
+	c.SetDefault("http_redirect_port", "")
+	c.SetDefault("http_redirect_exempt", "/_dsc/status,/_dsc/live,/_dsc/ready")
+	c.SetDefault("hsts_max_age", "0s")
+	c.SetDefault("hsts_include_subdomains", false)
+	c.SetDefault("hsts_preload", false)
+	c.SetDefault("tls_client_auth", "none")
+	c.SetDefault("tls_client_ca_file", "")
+	c.SetDefault("tls_client_rules", "")
+	c.SetDefault("tls_client_identity_header", "X-Forwarded-Client-Cert")
 	c.SetDefault("http_drain_interval", "1s")
+	c.SetDefault("shutdown_delay", "5s")
 	c.SetDefault("cors_origins_allowed", "localhost.host.tld,localhost,www.foo.com")
 	c.SetDefault("cors_headers_allowed", "DNT,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Range")
-	c.SetDefault("cors_expose_headers", "Content-Type,X-DSC-Value,X-Ratelimit-Limit,X-Ratelimit-Reset,X-Ratelimit-Remaining")
+	c.SetDefault("cors_expose_headers", "Content-Type,X-DSC-Value,X-Ratelimit-Limit,X-Ratelimit-Reset,X-Ratelimit-Remaining,RateLimit-Limit,RateLimit-Reset,RateLimit-Remaining,Retry-After,X-Request-ID")
 	c.SetDefault("cors_auth_allowed", true)
 	c.SetDefault("cors_cache_ttl", 3600)
 	c.SetDefault("throttle", "20,5")
 	c.SetDefault("throttle_period", "H")
 	c.SetDefault("throttle_redis_url", nil)
+	c.SetDefault("throttle_costs", "")
+	c.SetDefault("throttle_body_cost", 0)
+	c.SetDefault("throttle_action_service", "reject")
+	c.SetDefault("throttle_action_proxy", "reject")
+	c.SetDefault("tarpit_delay", "1s")
+	c.SetDefault("tarpit_max_delay", "30s")
+	c.SetDefault("tarpit_max_held", 100)
+	c.SetDefault("tarpit_then", "reject")
+	c.SetDefault("throttle_denied_format", "text")
+	c.SetDefault("throttle_denied_template", "")
+	c.SetDefault("throttle_denied_content_type", "")
+	c.SetDefault("concurrency_algorithm", "")
+	c.SetDefault("concurrency_limit", 20)
+	c.SetDefault("concurrency_max_limit", 200)
+	c.SetDefault("concurrency_queue", 100)
+	c.SetDefault("concurrency_queue_timeout", "1s")
+	c.SetDefault("concurrency_routes", "")
+	c.SetDefault("response_throttle_routes", "")
+	c.SetDefault("response_throttle", "10,5")
+	c.SetDefault("response_throttle_period", "H")
+	c.SetDefault("response_throttle_statuses", "401,403")
+	c.SetDefault("response_throttle_key", "client")
+	c.SetDefault("peers", "")
+	c.SetDefault("peers_dns", "")
+	c.SetDefault("peers_dns_interval", "10s")
+	c.SetDefault("peer_addr", ":7946")
+	c.SetDefault("peer_advertise", "")
+	c.SetDefault("snapshot_file", "")
+	c.SetDefault("snapshot_interval", "1m")
+	c.SetDefault("websocket_idle_timeout", "5m")
+	c.SetDefault("websocket_max_lifetime", "0s")
+	c.SetDefault("http_read_header_timeout", "10s")
+	c.SetDefault("http_read_timeout", "0s")
+	c.SetDefault("http_write_timeout", "0s")
+	c.SetDefault("http_idle_timeout", "2m")
+	c.SetDefault("http_max_header_bytes", http.DefaultMaxHeaderBytes)
+	c.SetDefault("max_body_bytes", 0)
+	c.SetDefault("limits_routes", "")
+	c.SetDefault("upstream_timeout", "0s")
+	c.SetDefault("upstream_timeout_routes", "")
+	c.SetDefault("upstream_retries", 0)
+	c.SetDefault("upstream_retry_backoff", "100ms")
+	c.SetDefault("upstream_retry_budget", 0.2)
+	c.SetDefault("upstream_breaker_failures", 0)
+	c.SetDefault("upstream_breaker_cooldown", "30s")
+	c.SetDefault("upstream_fallback_status", http.StatusServiceUnavailable)
+	c.SetDefault("upstream_fallback_content_type", "text/plain; charset=utf-8")
+	c.SetDefault("upstream_fallback_body", "Service temporarily unavailable.\n")
+	c.SetDefault("request_id_header", "X-Request-ID")
+	c.SetDefault("request_id_trusted", "")
+	c.SetDefault("trusted_proxies", "")
+	c.SetDefault("upstream_h2c", false)
+	c.SetDefault("upstream_flush_interval", "100ms")
+	c.SetDefault("upstream_host_mode", "rewrite")
+	c.SetDefault("forwarded_headers", "keep")
 	c.SetDefault("custom_header", nil)
+	c.SetDefault("upstream_headers", "")
+	c.SetDefault("response_headers", "remove Server | remove X-Powered-By | default X-Content-Type-Options: nosniff")
 	c.SetDefault("proto", "dsc")
+	c.SetDefault("keep_dsc_params", false)
+	c.SetDefault("ban_max_failures", 0)
+	c.SetDefault("ban_window", "10m")
+	c.SetDefault("ban_time", "5m")
+	c.SetDefault("ban_max_time", "24h")
+	c.SetDefault("admin_token", "")
+	c.SetDefault("admin_addr", "")
+	c.SetDefault("admin_listener_token", "")
+	c.SetDefault("health_timeout", "2s")
+	c.SetDefault("health_cache_ttl", "5s")
+	c.SetDefault("health_upstream_path", "/")
 
 	c.AutomaticEnv()
 
@@ -62,7 +166,7 @@ func main() {
 		logrus.Fatal(err)
 	}
 	for _, key := range config.AllKeys() {
-		if key != "secret" {
+		if key != "secret" && key != "admin_token" && key != "admin_listener_token" {
 			logrus.Printf("dsc_%s=%s", key, config.GetString(key))
 		}
 	}
@@ -77,10 +181,54 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	var timeouts [4]time.Duration
+	for i, key := range []string{"http_read_header_timeout", "http_read_timeout", "http_write_timeout",
+		"http_idle_timeout"} {
+		if timeouts[i], err = time.ParseDuration(config.GetString(key)); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	// Side listeners get the main server's limits and are shut down along with it.
+	var side []*http.Server
+	serveSide := func(addr string, h http.Handler) {
+		s := &http.Server{Addr: addr, Handler: h,
+			ReadHeaderTimeout: timeouts[0],
+			ReadTimeout:       timeouts[1],
+			WriteTimeout:      timeouts[2],
+			IdleTimeout:       timeouts[3],
+			MaxHeaderBytes:    config.GetInt("http_max_header_bytes"),
+		}
+		side = append(side, s)
+		go func() {
+			if err := s.ListenAndServe(); err != http.ErrServerClosed {
+				logrus.Fatal(err)
+			}
+		}()
+	}
+
+	if peers := app.PeerHandler(); peers != nil {
+		peerAddress := config.GetString("peer_addr")
+		logrus.Infoln("Sharing throttle state with peers on " + peerAddress)
+		serveSide(peerAddress, peers)
+	}
+
+	admin, err := app.AdminHandler()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if admin != nil {
+		adminAddress := config.GetString("admin_addr")
+		logrus.Infoln("Running admin server on " + adminAddress)
+		serveSide(adminAddress, admin)
+	}
+
 	serverAddress := config.Get("http_addr").(string)
 
-	certFile := config.Get("http_cert_file").(string)
-	keyFile := config.Get("http_key_file").(string)
+	tlsConfig, err := app.TLSConfig()
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	drainIntervalString := config.Get("http_drain_interval").(string)
 
 	drainInterval, err := time.ParseDuration(drainIntervalString)
@@ -88,6 +236,11 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	shutdownDelay, err := time.ParseDuration(config.GetString("shutdown_delay"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
 	headersOk := gorilla_handlers.AllowedHeaders(strings.Split(config.GetString("cors_headers_allowed"), ","))
 	originsOk := gorilla_handlers.AllowedOrigins([]string{})
 	validator := gorilla_handlers.AllowedOriginValidator(originValidator)
@@ -96,24 +249,93 @@ func main() {
 	credentials := gorilla_handlers.AllowCredentials()
 	expose := gorilla_handlers.ExposedHeaders(strings.Split(config.GetString("cors_expose_headers"), ","))
 
-	srv := &graceful.Server{
-		Timeout: drainInterval,
-		Server: &http.Server{Addr: serverAddress,
-			Handler: gorilla_handlers.CORS(headersOk, originsOk, validator, credentials, methodsOk,
-				expose)(middle)},
+	srv := &http.Server{Addr: serverAddress,
+		Handler: gorilla_handlers.CORS(headersOk, originsOk, validator, credentials, methodsOk,
+			expose)(middle),
+		ReadHeaderTimeout: timeouts[0],
+		ReadTimeout:       timeouts[1],
+		WriteTimeout:      timeouts[2],
+		IdleTimeout:       timeouts[3],
+		MaxHeaderBytes:    config.GetInt("http_max_header_bytes"),
 	}
 
 	logrus.Infoln("Running HTTP server on " + serverAddress)
 
-	if certFile != "" && keyFile != "" {
-		fmt.Println("Serving with TLS enabled")
-		err = srv.ListenAndServeTLS(certFile, keyFile)
-	} else {
-		fmt.Println("Warning! Serving clear text http!")
-		err = srv.ListenAndServe()
+	if redirectAddress := config.GetString("http_redirect_addr"); redirectAddress != "" {
+		if tlsConfig == nil {
+			logrus.Fatal("DSC_HTTP_REDIRECT_ADDR needs TLS to be enabled")
+		}
+		redirect, err := app.RedirectHandler(srv.Handler)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infoln("Redirecting HTTP to HTTPS on " + redirectAddress)
+		serveSide(redirectAddress, redirect)
 	}
 
-	if err != nil {
+	errc := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			fmt.Println("Serving with TLS enabled")
+			srv.TLSConfig = tlsConfig
+			if !application.HTTP2(tlsConfig) {
+				// A non nil map keeps net/http from setting up HTTP/2 on its own.
+				srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+			}
+			errc <- srv.ListenAndServeTLS("", "")
+		} else {
+			fmt.Println("Warning! Serving clear text http!")
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err = <-errc:
+	case sig := <-signals:
+		signal.Stop(signals)
+		err = shutdown(app, srv, side, sig, shutdownDelay, drainInterval)
+	}
+
+	if cerr := app.Close(); cerr != nil {
+		logrus.Error(cerr)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		logrus.Fatal(err)
 	}
+	logrus.Infoln("Shutdown complete")
+}
+
+// shutdown stops the servers in stages: the instance is reported not ready first and keeps serving for delay
+// so load balancers can take it out of rotation, then keep-alives are disabled and in flight requests get up
+// to drain to finish before the remaining connections, websockets included, are closed.
+func shutdown(app *application.Application, srv *http.Server, side []*http.Server, sig os.Signal,
+	delay, drain time.Duration) error {
+	logrus.Infof("Received %s, marking the instance as not ready", sig)
+	app.Drain()
+	if delay > 0 {
+		logrus.Infof("Waiting %s for load balancers to notice", delay)
+		time.Sleep(delay)
+	}
+
+	logrus.Infof("Draining connections for up to %s", drain)
+	srv.SetKeepAlivesEnabled(false)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		logrus.Warnln("Drain interval exceeded, closing the remaining connections")
+		err = srv.Close()
+	}
+	if closed := app.DrainUpgrades(ctx); closed > 0 {
+		logrus.Warnf("Closed %d upgraded connections", closed)
+	}
+	for _, s := range side {
+		if serr := s.Shutdown(ctx); serr != nil {
+			s.Close()
+		}
+	}
+	return err
 }
@@ -0,0 +1,336 @@
+// Package peerstore offers a throttled.GCRAStore shared by a fleet of DSC instances without redis. Every key is
+// owned by one peer, picked by consistent hashing over the peer list, and operations on keys owned by other peers
+// are forwarded to them over http.
+package peerstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/throttled/throttled"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// replicas is the number of points each peer gets on the hash ring.
+const replicas = 64
+
+// Path is where peers expose their store.
+const Path = "/_dsc/peer"
+
+const (
+	signatureHeader = "X-DSC-Peer-Signature"
+	timestampHeader = "X-DSC-Peer-Timestamp"
+)
+
+// maxSkew is how far a peer request timestamp may be from the local clock, older requests are taken as replays.
+const maxSkew = 30 * time.Second
+
+// minBackoff and maxBackoff bound how long an unreachable peer is skipped before being tried again.
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// Store is a throttled.GCRAStore whose keys are spread across peers.
+type Store struct {
+	self   string
+	local  throttled.GCRAStore
+	secret []byte
+	client *http.Client
+	log    *logrus.Logger
+
+	mu     sync.RWMutex
+	hashes []uint32
+	owners map[uint32]string
+	peers  []string
+
+	downMu sync.Mutex
+	down   map[string]downPeer
+}
+
+// downPeer tracks a peer that failed, it's skipped until retry.
+type downPeer struct {
+	failures uint
+	retry    time.Time
+}
+
+type request struct {
+	Op    string        `json:"op"`
+	Key   string        `json:"key"`
+	Value int64         `json:"value"`
+	Old   int64         `json:"old"`
+	TTL   time.Duration `json:"ttl"`
+}
+
+type response struct {
+	Value int64 `json:"value"`
+	OK    bool  `json:"ok"`
+	Now   int64 `json:"now"`
+}
+
+// New returns a Store for the peer advertised as self, keeping the keys it owns in local. Peer requests are
+// signed with secret.
+func New(self string, local throttled.GCRAStore, secret []byte, log *logrus.Logger) *Store {
+	s := &Store{
+		self:   self,
+		local:  local,
+		secret: secret,
+		client: &http.Client{Timeout: time.Second},
+		log:    log,
+		down:   make(map[string]downPeer),
+	}
+	s.SetPeers([]string{self})
+	return s
+}
+
+// SetPeers replaces the peer list, self is always part of it.
+func (s *Store) SetPeers(peers []string) {
+	seen := map[string]bool{s.self: true}
+	list := []string{s.self}
+	for _, p := range peers {
+		if !seen[p] {
+			seen[p] = true
+			list = append(list, p)
+		}
+	}
+	sort.Strings(list)
+
+	owners := make(map[uint32]string, len(list)*replicas)
+	hashes := make([]uint32, 0, len(list)*replicas)
+	for _, p := range list {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + p))
+			owners[h] = p
+			hashes = append(hashes, h)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log != nil && fmt.Sprint(list) != fmt.Sprint(s.peers) {
+		s.log.WithFields(logrus.Fields{"peers": list}).Info("Throttle peers changed.")
+	}
+	s.hashes, s.owners, s.peers = hashes, owners, list
+}
+
+// Peers returns the current peer list.
+func (s *Store) Peers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.peers...)
+}
+
+// Discover refreshes the peer list every interval, resolving name to addresses listening on port, until stop is
+// closed.
+func (s *Store) Discover(name, port string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		addrs, err := net.LookupHost(name)
+		if err != nil {
+			s.log.WithFields(logrus.Fields{"name": name}).Warn(err)
+		} else {
+			peers := make([]string, 0, len(addrs))
+			for _, a := range addrs {
+				peers = append(peers, net.JoinHostPort(a, port))
+			}
+			s.SetPeers(peers)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Store) owner(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.hashes), func(i int) bool { return s.hashes[i] >= h })
+	if i == len(s.hashes) {
+		i = 0
+	}
+	return s.owners[s.hashes[i]]
+}
+
+// GetWithTime implements throttled.GCRAStore.
+func (s *Store) GetWithTime(key string) (int64, time.Time, error) {
+	resp, err := s.do(request{Op: "get", Key: key})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return resp.Value, time.Unix(0, resp.Now), nil
+}
+
+// SetIfNotExistsWithTTL implements throttled.GCRAStore.
+func (s *Store) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	resp, err := s.do(request{Op: "set", Key: key, Value: value, TTL: ttl})
+	return resp.OK, err
+}
+
+// CompareAndSwapWithTTL implements throttled.GCRAStore.
+func (s *Store) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	resp, err := s.do(request{Op: "cas", Key: key, Old: old, Value: new, TTL: ttl})
+	return resp.OK, err
+}
+
+// do runs req on the owner of its key. When the owner is unreachable the local store answers, degrading to
+// per-instance limits rather than failing requests, and the owner is skipped for a while.
+func (s *Store) do(req request) (response, error) {
+	owner := s.owner(req.Key)
+	if owner == s.self || s.isDown(owner, time.Now()) {
+		return s.apply(req)
+	}
+	resp, err := s.forward(owner, req)
+	if err != nil {
+		s.markDown(owner, time.Now(), err)
+		return s.apply(req)
+	}
+	s.markUp(owner)
+	return resp, nil
+}
+
+func (s *Store) isDown(peer string, now time.Time) bool {
+	s.downMu.Lock()
+	defer s.downMu.Unlock()
+	d, ok := s.down[peer]
+	return ok && now.Before(d.retry)
+}
+
+// markDown skips peer for a backoff doubling with every consecutive failure.
+func (s *Store) markDown(peer string, now time.Time, err error) {
+	s.downMu.Lock()
+	defer s.downMu.Unlock()
+	d := s.down[peer]
+	backoff := maxBackoff
+	if d.failures < 5 {
+		backoff = minBackoff << d.failures
+	}
+	d.failures++
+	d.retry = now.Add(backoff)
+	s.down[peer] = d
+	s.log.WithFields(logrus.Fields{"peer": peer, "retry_in": backoff.String()}).Warn(err)
+}
+
+func (s *Store) markUp(peer string) {
+	s.downMu.Lock()
+	defer s.downMu.Unlock()
+	if _, ok := s.down[peer]; ok {
+		delete(s.down, peer)
+		s.log.WithFields(logrus.Fields{"peer": peer}).Info("Throttle peer is back.")
+	}
+}
+
+func (s *Store) apply(req request) (response, error) {
+	var resp response
+	var err error
+	switch req.Op {
+	case "get":
+		var now time.Time
+		resp.Value, now, err = s.local.GetWithTime(req.Key)
+		resp.Now = now.UnixNano()
+	case "set":
+		resp.OK, err = s.local.SetIfNotExistsWithTTL(req.Key, req.Value, req.TTL)
+	case "cas":
+		resp.OK, err = s.local.CompareAndSwapWithTTL(req.Key, req.Old, req.Value, req.TTL)
+	default:
+		err = errors.Errorf("unknown peer store operation %q", req.Op)
+	}
+	return resp, err
+}
+
+// sign signs body along with the request timestamp, so a captured request can't be replayed later.
+func (s *Store) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = mac.Write([]byte(timestamp + "\n"))
+	_, _ = mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Store) forward(peer string, req request) (response, error) {
+	var resp response
+	body, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	r, err := http.NewRequest("POST", "http://"+peer+Path, bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(timestampHeader, timestamp)
+	r.Header.Set(signatureHeader, s.sign(timestamp, body))
+	res, err := s.client.Do(r)
+	if err != nil {
+		return resp, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return resp, errors.Errorf("peer %s answered %s", peer, res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	return resp, err
+}
+
+// fresh tells whether the unix timestamp is within maxSkew of now.
+func fresh(timestamp string, now time.Time) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(sec, 0))
+	return skew < maxSkew && skew > -maxSkew
+}
+
+// ServeHTTP answers the store operations forwarded by other peers.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != Path {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timestamp := r.Header.Get(timestampHeader)
+	sig, _ := base64.StdEncoding.DecodeString(r.Header.Get(signatureHeader))
+	expected, _ := base64.StdEncoding.DecodeString(s.sign(timestamp, body))
+	if !hmac.Equal(sig, expected) {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+	if !fresh(timestamp, time.Now()) {
+		http.Error(w, "stale request", http.StatusForbidden)
+		return
+	}
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.apply(req)
+	if err != nil {
+		s.log.Error(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,148 @@
+package peerstore
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFleet(t *testing.T, n int) ([]*Store, func()) {
+	t.Helper()
+	var stores []*Store
+	var servers []*httptest.Server
+	var addrs []string
+	for i := 0; i < n; i++ {
+		mux := http.NewServeMux()
+		srv := httptest.NewServer(mux)
+		addr := strings.TrimPrefix(srv.URL, "http://")
+		local, _ := memstore.New(0)
+		s := New(addr, local, []byte("averylongsecretstring"), logrus.New())
+		mux.Handle(Path, s)
+		stores = append(stores, s)
+		servers = append(servers, srv)
+		addrs = append(addrs, addr)
+	}
+	for _, s := range stores {
+		s.SetPeers(addrs)
+	}
+	return stores, func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+}
+
+func TestFleetWideLimit(t *testing.T) {
+	stores, closeAll := newFleet(t, 3)
+	defer closeAll()
+
+	var limiters []*throttled.GCRARateLimiter
+	for _, s := range stores {
+		l, err := throttled.NewGCRARateLimiter(s, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		limiters = append(limiters, l)
+	}
+
+	// Three requests spread over the fleet exhaust the quota for every instance.
+	for i := 0; i < 3; i++ {
+		for k := 0; k < 10; k++ {
+			limited, _, err := limiters[i].RateLimit("client-"+strconv.Itoa(k), 1)
+			if err != nil || limited {
+				t.Fatalf("request %d for client-%d was limited: %v", i, k, err)
+			}
+		}
+	}
+	for i := range limiters {
+		limited, _, err := limiters[i].RateLimit("client-0", 1)
+		if err != nil || !limited {
+			t.Errorf("instance %d did not enforce the fleet limit: %v", i, err)
+		}
+	}
+}
+
+func TestOwnershipSpread(t *testing.T) {
+	stores, closeAll := newFleet(t, 3)
+	defer closeAll()
+
+	owners := make(map[string]int)
+	for k := 0; k < 300; k++ {
+		key := "client-" + strconv.Itoa(k)
+		owner := stores[0].owner(key)
+		for _, s := range stores[1:] {
+			if s.owner(key) != owner {
+				t.Fatalf("peers disagree on the owner of %s", key)
+			}
+		}
+		owners[owner]++
+	}
+	if len(owners) != 3 {
+		t.Errorf("keys are not spread over the fleet: %v", owners)
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	local, _ := memstore.New(0)
+	s := New("127.0.0.1:1", local, []byte("averylongsecretstring"), logrus.New())
+	req := httptest.NewRequest("POST", Path, strings.NewReader(`{"op":"set","key":"k","value":1}`))
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("unsigned request got status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestDeadPeerIsSkipped(t *testing.T) {
+	local, _ := memstore.New(0)
+	s := New("127.0.0.1:1", local, []byte("averylongsecretstring"), logrus.New())
+	s.SetPeers([]string{"127.0.0.1:2"})
+
+	var key string
+	for k := 0; ; k++ {
+		key = "client-" + strconv.Itoa(k)
+		if s.owner(key) == "127.0.0.1:2" {
+			break
+		}
+	}
+	if _, err := s.SetIfNotExistsWithTTL(key, 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if !s.isDown("127.0.0.1:2", now) {
+		t.Fatal("unreachable peer was not marked down")
+	}
+	if s.isDown("127.0.0.1:2", now.Add(minBackoff)) {
+		t.Error("peer was not retried after the first backoff")
+	}
+	s.markDown("127.0.0.1:2", now, errors.New("still down"))
+	if !s.isDown("127.0.0.1:2", now.Add(minBackoff)) {
+		t.Error("backoff did not grow with consecutive failures")
+	}
+	s.markUp("127.0.0.1:2")
+	if s.isDown("127.0.0.1:2", now) {
+		t.Error("peer answering again is still marked down")
+	}
+}
+
+func TestReplayedRequest(t *testing.T) {
+	local, _ := memstore.New(0)
+	s := New("127.0.0.1:1", local, []byte("averylongsecretstring"), logrus.New())
+	body := `{"op":"set","key":"k","value":1}`
+	timestamp := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	req := httptest.NewRequest("POST", Path, strings.NewReader(body))
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, s.sign(timestamp, []byte(body)))
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("replayed request got status code: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
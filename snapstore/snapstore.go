@@ -0,0 +1,188 @@
+// Package snapstore wraps an in-memory throttled.GCRAStore so that its state can be saved to a local file and
+// restored on startup, keeping rate limits and bans across restarts.
+package snapstore
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/throttled/throttled"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store is a throttled.GCRAStore which remembers the keys written to the store it wraps along with their expiry,
+// as throttled's memstore can neither list its keys nor expire them.
+type Store struct {
+	throttled.GCRAStore
+	mu      sync.Mutex
+	expires map[string]time.Time
+	// prune is the number of tracked keys past which writes sweep the expired ones.
+	prune int
+}
+
+// minPrune is the smallest number of tracked keys writes start sweeping at.
+const minPrune = 1024
+
+// Entry is a key saved in a snapshot.
+type Entry struct {
+	Key     string    `json:"key"`
+	Value   int64     `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+// New wraps store.
+func New(store throttled.GCRAStore) *Store {
+	return &Store{GCRAStore: store, expires: make(map[string]time.Time), prune: minPrune}
+}
+
+// track records the expiry of key. Whenever the tracked keys double, the expired ones are forgotten, which keeps
+// the map bounded even when no snapshot is ever taken.
+func (s *Store) track(key string, ttl time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expires[key] = now.Add(ttl)
+	if len(s.expires) < s.prune {
+		return
+	}
+	for k, expires := range s.expires {
+		if expires.Before(now) {
+			delete(s.expires, k)
+		}
+	}
+	s.prune = 2 * len(s.expires)
+	if s.prune < minPrune {
+		s.prune = minPrune
+	}
+}
+
+// SetIfNotExistsWithTTL implements throttled.GCRAStore.
+func (s *Store) SetIfNotExistsWithTTL(key string, value int64, ttl time.Duration) (bool, error) {
+	ok, err := s.GCRAStore.SetIfNotExistsWithTTL(key, value, ttl)
+	if ok {
+		s.track(key, ttl)
+	}
+	return ok, err
+}
+
+// CompareAndSwapWithTTL implements throttled.GCRAStore.
+func (s *Store) CompareAndSwapWithTTL(key string, old, new int64, ttl time.Duration) (bool, error) {
+	ok, err := s.GCRAStore.CompareAndSwapWithTTL(key, old, new, ttl)
+	if ok {
+		s.track(key, ttl)
+	}
+	return ok, err
+}
+
+// Entries returns the keys still alive in the store, forgetting expired and evicted ones. The wrapped store is
+// read without holding the lock, so writes aren't blocked while a snapshot is taken.
+func (s *Store) Entries() ([]Entry, error) {
+	now := time.Now()
+	s.mu.Lock()
+	tracked := make([]Entry, 0, len(s.expires))
+	for key, expires := range s.expires {
+		tracked = append(tracked, Entry{Key: key, Expires: expires})
+	}
+	s.mu.Unlock()
+
+	entries := make([]Entry, 0, len(tracked))
+	var dead []Entry
+	for _, e := range tracked {
+		value, _, err := s.GCRAStore.GetWithTime(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		if value == -1 || e.Expires.Before(now) {
+			dead = append(dead, e)
+			continue
+		}
+		e.Value = value
+		entries = append(entries, e)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range dead {
+		// The key may have been written again meanwhile.
+		if s.expires[e.Key].Equal(e.Expires) {
+			delete(s.expires, e.Key)
+		}
+	}
+	return entries, nil
+}
+
+// Save writes a snapshot to path, atomically replacing the previous one.
+func (s *Store) Save(path string) error {
+	entries, err := s.Entries()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".dsc-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load restores the snapshot at path, dropping expired entries. A missing snapshot isn't an error. It returns
+// the number of keys restored.
+func (s *Store) Load(path string) (int, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	restored := 0
+	for _, e := range entries {
+		ttl := e.Expires.Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		ok, err := s.SetIfNotExistsWithTTL(e.Key, e.Value, ttl)
+		if err != nil {
+			return restored, err
+		}
+		if ok {
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// Run saves a snapshot to path every interval until stop is closed.
+func (s *Store) Run(path string, interval time.Duration, stop <-chan struct{}, log *logrus.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(path); err != nil {
+				log.WithFields(logrus.Fields{"path": path}).Error(err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package snapstore
+
+import (
+	"github.com/throttled/throttled"
+	"github.com/throttled/throttled/store/memstore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	mem, _ := memstore.New(0)
+	before := New(mem)
+	limiter, _ := throttled.NewGCRARateLimiter(before, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	if limited, _, _ := limiter.RateLimit("client", 1); limited {
+		t.Fatal("first request was limited")
+	}
+	if _, err := before.SetIfNotExistsWithTTL("expired", 1, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := before.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	mem, _ = memstore.New(0)
+	after := New(mem)
+	restored, err := after.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 {
+		t.Errorf("restored %d keys, want 1", restored)
+	}
+	limiter, _ = throttled.NewGCRARateLimiter(after, throttled.RateQuota{MaxRate: throttled.PerMin(1), MaxBurst: 0})
+	if limited, _, _ := limiter.RateLimit("client", 1); !limited {
+		t.Error("restarting reset the client's budget")
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	mem, _ := memstore.New(0)
+	if n, err := New(mem).Load("/nonexistent/snapshot.json"); err != nil || n != 0 {
+		t.Errorf("missing snapshot: got %d, %v", n, err)
+	}
+}
+
+func TestWritesPruneExpiredKeys(t *testing.T) {
+	mem, _ := memstore.New(0)
+	s := New(mem)
+	for i := 0; i < 10*minPrune; i++ {
+		if _, err := s.SetIfNotExistsWithTTL("key-"+strconv.Itoa(i), 1, time.Nanosecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mu.Lock()
+	tracked := len(s.expires)
+	s.mu.Unlock()
+	if tracked > minPrune {
+		t.Errorf("expired keys are still tracked: got %d, want at most %d", tracked, minPrune)
+	}
+}